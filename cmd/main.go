@@ -2,12 +2,11 @@ package main
 
 import (
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
+	"github.com/Vladroon22/DNS-Server/internal/config"
 	"github.com/Vladroon22/DNS-Server/internal/logger"
 	"github.com/Vladroon22/DNS-Server/internal/server"
 	"github.com/joho/godotenv"
@@ -23,20 +22,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	port, err := strconv.Atoi((os.Getenv("udp_port")))
+	cfg, err := config.Load()
 	if err != nil {
 		myLogger.Log(logger.LogEntry{Info: err.Error()})
 		os.Exit(1)
 	}
 
-	stopServerChan := make(chan error, 1)
+	stopServerChan := make(chan error, 5)
 	stopOSChan := make(chan os.Signal, 1)
 	signal.Notify(stopOSChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	configUDP := &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}
-
-	srv := server.DNSServer(configUDP, 20, myLogger)
-	myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("Starting server on port %d", port)})
+	srv, err := server.DNSServer(cfg, myLogger)
+	if err != nil {
+		myLogger.Log(logger.LogEntry{Info: err.Error()})
+		os.Exit(1)
+	}
+	myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("Starting server on udp port %d and tcp port %d", cfg.UDPPort, cfg.TCPPort)})
 
 	go func() {
 		if err := srv.StartUDP(); err != nil {
@@ -44,6 +45,39 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := srv.StartTCP(); err != nil {
+			stopServerChan <- err
+		}
+	}()
+
+	if cfg.TLSPort != 0 {
+		myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("Starting DNS-over-TLS on port %d", cfg.TLSPort)})
+		go func() {
+			if err := srv.StartTLS(); err != nil {
+				stopServerChan <- err
+			}
+		}()
+	}
+
+	if cfg.DoHPort != 0 {
+		myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("Starting DNS-over-HTTPS on port %d%s", cfg.DoHPort, cfg.DoHPath)})
+		go func() {
+			if err := srv.StartHTTPS(); err != nil {
+				stopServerChan <- err
+			}
+		}()
+	}
+
+	if cfg.QUICPort != 0 {
+		myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("Starting DNS-over-QUIC on port %d", cfg.QUICPort)})
+		go func() {
+			if err := srv.StartQUIC(); err != nil {
+				stopServerChan <- err
+			}
+		}()
+	}
+
 	select {
 	case err := <-stopServerChan:
 		myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("DNS error: %v", err)})
@@ -51,7 +85,7 @@ func main() {
 	case sig := <-stopOSChan:
 		myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("Received %v signal, shutting down...", sig)})
 
-		if err := srv.CloseUDP(); err != nil {
+		if err := srv.Close(); err != nil {
 			myLogger.Log(logger.LogEntry{Info: fmt.Sprintf("DNS shutdown error: %v", err)})
 		}
 	}
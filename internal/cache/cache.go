@@ -1,68 +1,215 @@
 package cache
 
 import (
-	"net"
-	"sync"
+	"hash/maphash"
+	"strings"
 	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/suffix"
 )
 
-type Item struct {
-	Class  uint16
-	Type   uint16
-	Length uint16
-	IP     net.IP
-	Name   string
-	Exp    time.Time
+// Key identifies an RRset. Names are compared case-insensitively, NewKey
+// lowercases them.
+type Key struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+func NewKey(name string, tp, class uint16) Key {
+	return Key{Name: strings.ToLower(strings.TrimSuffix(name, ".")), Type: tp, Class: class}
+}
+
+// DefaultNegativeTTLMax caps how long NXDOMAIN and NODATA answers are kept.
+const DefaultNegativeTTLMax = time.Hour
+
+// NXDomainKey is where the nonexistence of a name is cached. It holds for
+// every type, so the key uses type 0, which no record can have.
+func NXDomainKey(name string, class uint16) Key {
+	return NewKey(name, 0, class)
+}
+
+// RRset holds the RDATA of every record sharing a name, type and class.
+// A negative entry (RFC 2308) has no records, instead it keeps the SOA of the
+// zone that denied the name, to be served in the authority section.
+type RRset struct {
+	Key
+	Records [][]byte
+	Exp     time.Time
+
+	Rcode   uint8
+	SOAName string
+	SOA     []byte
+}
+
+// Negative reports whether the entry is a cached NXDOMAIN or NODATA.
+func (r RRset) Negative() bool {
+	return r.SOA != nil
 }
 
+type Options struct {
+	NegativeTTLMax time.Duration
+	MaxEntries     int    // 0 - unlimited
+	MaxBytes       int64  // approximate memory budget, 0 - unlimited
+	Policy         Policy // chooses what is dropped when the cache is full
+	// StaleWindow keeps entries this long after they expire, to be served by
+	// GetStale when the upstreams can't be reached (RFC 8767)
+	StaleWindow time.Duration
+	// PrefetchHits is how many times an entry has to be asked for before it
+	// is refreshed ahead of expiry, 0 disables prefetching
+	PrefetchHits int
+	// Shards splits the cache to cut lock contention, rounded up to a power
+	// of two. 0 means four per CPU.
+	Shards int
+
+	// the TTLs given by upstreams are raised to MinTTL and cut to MaxTTL
+	// (0 - no limit), names under a suffix of TTLOverrides get its TTL instead
+	MinTTL       time.Duration
+	MaxTTL       time.Duration
+	TTLOverrides map[string]time.Duration
+}
+
+// Stats shows how full the cache is and why entries left it.
+type Stats struct {
+	Entries  int
+	Bytes    int64
+	Evicted  uint64 // removed to make room for new entries
+	Rejected uint64 // refused by the admission filter or too big to fit
+	Expired  uint64 // removed after their TTL and stale window ran out
+
+	Prefetches      uint64 // refreshes queued ahead of expiry
+	PrefetchDropped uint64 // refreshes skipped because the queue was full
+	PrefetchSaved   uint64 // refreshed entries asked for after the old ones would have expired
+	PrefetchFailed  uint64 // refreshes that ended without replacing the entry
+}
+
+// Cache is split into shards picked by the hash of the key, each with its
+// own lock, recency list, expiry heap and share of the limits, so lookups of
+// different names rarely wait for each other.
 type Cache struct {
-	cache  map[string]*Item
-	mtx    sync.RWMutex
-	exitCh chan struct{}
+	shards         []*shard
+	seed           maphash.Seed
+	mask           uint64
+	prefetchCh     chan Key // nil unless prefetching is enabled
+	negativeTTLMax time.Duration
+	minTTL         time.Duration
+	maxTTL         time.Duration
+	overrides      *suffix.Table[time.Duration]
+	exitCh         chan struct{}
 }
 
 func InitCache() *Cache {
+	return New(Options{})
+}
+
+func New(opts Options) *Cache {
+	if opts.NegativeTTLMax <= 0 {
+		opts.NegativeTTLMax = DefaultNegativeTTLMax
+	}
+
+	n := shardCount(opts)
 	chc := &Cache{
-		cache:  make(map[string]*Item),
-		mtx:    sync.RWMutex{},
-		exitCh: make(chan struct{}),
+		shards:         make([]*shard, n),
+		seed:           maphash.MakeSeed(),
+		mask:           uint64(n - 1),
+		negativeTTLMax: opts.NegativeTTLMax,
+		minTTL:         max(opts.MinTTL, 0),
+		maxTTL:         max(opts.MaxTTL, 0),
+		overrides:      newOverrides(opts.TTLOverrides),
+		exitCh:         make(chan struct{}),
+	}
+	if opts.PrefetchHits > 0 {
+		chc.prefetchCh = make(chan Key, prefetchQueue)
+	}
+	for i := range chc.shards {
+		chc.shards[i] = newShard(opts, n, chc.prefetchCh)
 	}
 	go chc.cleanRecords()
 
 	return chc
 }
 
-func (c *Cache) Set(ip []byte, name string, class, tp, len uint16, ttl uint32) {
-	if c.cache == nil {
-		c.cache = make(map[string]*Item)
+// shardFor returns the shard that holds key.
+func (c *Cache) shardFor(key Key) *shard {
+	return c.shards[maphash.Comparable(c.seed, key)&c.mask]
+}
+
+// Set stores the records of an RRset, replacing what was cached for key. ttl
+// is the one given by the upstream, the clamps and overrides apply to it.
+func (c *Cache) Set(key Key, records [][]byte, ttl uint32) {
+	if len(records) == 0 {
+		return
 	}
 
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+	c.set(RRset{
+		Key:     key,
+		Records: records,
+		Exp:     time.Now().Add(c.ttlFor(key, ttl, false)),
+	})
+}
 
-	item := &Item{
-		IP:     ip,
-		Name:   name,
-		Class:  class,
-		Type:   tp,
-		Length: len,
-		Exp:    time.Now().Add(time.Duration(ttl) * time.Second),
+// SetNegative caches that key has no data, or with NXDomainKey that the name
+// doesn't exist. soa is the RDATA of the SOA record owned by soaName.
+func (c *Cache) SetNegative(key Key, rcode uint8, soaName string, soa []byte, ttl uint32) {
+	if soa == nil {
+		return
 	}
 
-	c.cache[name] = item
+	c.set(RRset{
+		Key:     key,
+		Exp:     time.Now().Add(c.ttlFor(key, ttl, true)),
+		Rcode:   rcode,
+		SOAName: soaName,
+		SOA:     soa,
+	})
 }
 
-func (c *Cache) Get(tp uint16, dmn string) (Item, bool) {
-	c.mtx.RLock()
-	defer c.mtx.RUnlock()
+func (c *Cache) set(rrset RRset) {
+	c.shardFor(rrset.Key).set(rrset)
+}
 
-	if item, ok := c.cache[dmn]; ok {
-		if item.Type == tp && item.Exp.After(time.Now()) {
-			return *item, true
-		}
-	}
+// Get returns the RRset cached for key unless it has expired.
+func (c *Cache) Get(key Key) (RRset, bool) {
+	return c.shardFor(key).get(key, false)
+}
+
+// GetStale is Get that also returns RRsets expired less than the stale
+// window ago.
+func (c *Cache) GetStale(key Key) (RRset, bool) {
+	return c.shardFor(key).get(key, true)
+}
+
+// Prefetches delivers the keys of popular entries close to expiry, which the
+// receiver should resolve again to refresh them. It is nil when prefetching is
+// disabled.
+func (c *Cache) Prefetches() <-chan Key {
+	return c.prefetchCh
+}
 
-	return Item{}, false
+// PrefetchDone must be called once the refresh of a key from Prefetches is
+// over, whatever its outcome. If it didn't store a new answer the entry can
+// be prefetched again.
+func (c *Cache) PrefetchDone(key Key) {
+	c.shardFor(key).prefetchDone(key)
+}
+
+// Stats returns the current size of the cache and its eviction counters,
+// summed over the shards.
+func (c *Cache) Stats() Stats {
+	var total Stats
+	for _, sh := range c.shards {
+		st := sh.statistics()
+		total.Entries += st.Entries
+		total.Bytes += st.Bytes
+		total.Evicted += st.Evicted
+		total.Rejected += st.Rejected
+		total.Expired += st.Expired
+		total.Prefetches += st.Prefetches
+		total.PrefetchDropped += st.PrefetchDropped
+		total.PrefetchSaved += st.PrefetchSaved
+		total.PrefetchFailed += st.PrefetchFailed
+	}
+	return total
 }
 
 func (c *Cache) cleanRecords() {
@@ -79,16 +226,10 @@ func (c *Cache) cleanRecords() {
 	}
 }
 
+// cleanExpired removes the entries past their stale window from every shard.
 func (c *Cache) cleanExpired() {
-	now := time.Now()
-
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
-	for name, item := range c.cache {
-		if item.Exp.Before(now) {
-			delete(c.cache, name)
-		}
+	for _, sh := range c.shards {
+		sh.cleanExpired()
 	}
 }
 
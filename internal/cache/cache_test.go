@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRsetsByType(t *testing.T) {
+	c := InitCache()
+	defer c.Close()
+
+	c.Set(NewKey("Example.COM.", 1, 1), [][]byte{{10, 0, 0, 1}, {10, 0, 0, 2}}, 300)
+	c.Set(NewKey("example.com", 28, 1), [][]byte{make([]byte, 16)}, 300)
+
+	a, ok := c.Get(NewKey("EXAMPLE.com", 1, 1))
+	if !ok || len(a.Records) != 2 {
+		t.Fatalf("A RRset lost or incomplete: %+v", a)
+	}
+	if aaaa, ok := c.Get(NewKey("example.com", 28, 1)); !ok || len(aaaa.Records) != 1 {
+		t.Errorf("AAAA RRset lost: %+v", aaaa)
+	}
+	if _, ok := c.Get(NewKey("example.com", 1, 3)); ok {
+		t.Error("RRset of another class returned")
+	}
+}
+
+func TestExpiredRRsetNotReturned(t *testing.T) {
+	c := InitCache()
+	defer c.Close()
+
+	c.Set(NewKey("example.com", 1, 1), [][]byte{{10, 0, 0, 1}}, 0)
+	if _, ok := c.Get(NewKey("example.com", 1, 1)); ok {
+		t.Error("expired RRset returned")
+	}
+}
+
+func TestNegativeTTLCapped(t *testing.T) {
+	c := New(Options{NegativeTTLMax: time.Minute})
+	defer c.Close()
+
+	c.SetNegative(NXDomainKey("missing.example.com", 1), 3, "example.com", []byte{0}, 86400)
+
+	rrset, ok := c.Get(NXDomainKey("Missing.Example.com.", 1))
+	if !ok || !rrset.Negative() || rrset.Rcode != 3 {
+		t.Fatalf("negative entry lost: %+v", rrset)
+	}
+	if ttl := time.Until(rrset.Exp); ttl > time.Minute {
+		t.Errorf("negative TTL must be capped at 1m, got %v", ttl)
+	}
+}
+
+func TestStaleWindow(t *testing.T) {
+	c := New(Options{StaleWindow: time.Hour})
+	defer c.Close()
+
+	c.Set(NewKey("example.com", 1, 1), [][]byte{{10, 0, 0, 1}}, 0)
+	if _, ok := c.Get(NewKey("example.com", 1, 1)); ok {
+		t.Error("expired RRset returned by Get")
+	}
+	if _, ok := c.GetStale(NewKey("example.com", 1, 1)); !ok {
+		t.Error("expired RRset within the stale window not returned by GetStale")
+	}
+
+	c.cleanExpired()
+	if st := c.Stats(); st.Entries != 1 {
+		t.Errorf("stale RRset removed before its window ran out: %+v", st)
+	}
+}
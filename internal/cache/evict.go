@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"time"
+)
+
+type Policy string
+
+const (
+	LRU     Policy = "lru"     // drop the least recently used entry
+	TinyLFU Policy = "tinylfu" // LRU, but a new entry must be asked for more often than the one it replaces
+)
+
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case LRU, TinyLFU:
+		return p, nil
+	case "":
+		return LRU, nil
+	default:
+		return "", fmt.Errorf("unknown cache policy %q", name)
+	}
+}
+
+// entryOverhead approximates the memory an entry takes besides its names and
+// RDATA: the entry itself, its list element and map slot.
+const entryOverhead = 160
+
+// size estimates the memory held by the cached RRset.
+func (r RRset) size() int64 {
+	n := entryOverhead + len(r.Name) + len(r.SOAName) + len(r.SOA)
+	for _, rec := range r.Records {
+		n += 24 + len(rec) // slice header and data
+	}
+	return int64(n)
+}
+
+// over reports whether the shard holds more than its limits allow.
+func (sh *shard) over() bool {
+	return (sh.maxEntries > 0 && len(sh.cache) > sh.maxEntries) || (sh.maxBytes > 0 && sh.bytes > sh.maxBytes)
+}
+
+// full reports whether an entry of size bytes would push the cache over its
+// limits.
+func (sh *shard) full(size int64) bool {
+	return (sh.maxEntries > 0 && len(sh.cache) >= sh.maxEntries) || (sh.maxBytes > 0 && sh.bytes+size > sh.maxBytes)
+}
+
+// admit decides whether a new entry of size bytes goes in. Plain LRU takes
+// everything that fits at all. TinyLFU keeps the LRU victim when it has been
+// asked for at least as often as key, so a scan of one-off names can't flush
+// the popular ones.
+func (sh *shard) admit(key Key, size int64) bool {
+	if sh.maxBytes > 0 && size > sh.maxBytes {
+		return false
+	}
+	if sh.sketch == nil || !sh.full(size) {
+		return true
+	}
+	if len(sh.expiry) > 0 && !sh.expiry[0].rrset.Exp.After(time.Now()) {
+		return true
+	}
+
+	victim := sh.lru.Back().Value.(*entry)
+	return sh.sketch.estimate(key) > sh.sketch.estimate(victim.rrset.Key)
+}
+
+// evict removes entries until the shard is back within its limits, expired
+// ones first and then the least recently used.
+func (sh *shard) evict() {
+	now := time.Now()
+	for sh.lru.Len() > 0 && sh.over() {
+		if e := sh.expiry[0]; !e.rrset.Exp.After(now) {
+			sh.remove(e)
+			sh.stats.Expired++
+			continue
+		}
+
+		sh.remove(sh.lru.Back().Value.(*entry))
+		sh.stats.Evicted++
+	}
+}
+
+// sketch is a count-min sketch of how often keys are asked for, the frequency
+// estimate behind TinyLFU. Counters saturate at 15 and are all halved once
+// enough lookups were counted, so old popularity fades.
+type sketch struct {
+	seed    maphash.Seed
+	rows    [4][]uint8
+	mask    uint64
+	added   int
+	resetAt int
+}
+
+func newSketch(entries int) *sketch {
+	width := uint64(1) << bits.Len(uint(max(entries, 1024)-1))
+
+	s := &sketch{seed: maphash.MakeSeed(), mask: width - 1, resetAt: int(width) * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) hash(key Key) uint64 {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	h.WriteString(key.Name)
+	h.WriteByte(byte(key.Type >> 8))
+	h.WriteByte(byte(key.Type))
+	h.WriteByte(byte(key.Class >> 8))
+	h.WriteByte(byte(key.Class))
+	return h.Sum64()
+}
+
+// index returns the counter of key in row i, double hashing the halves of h.
+func (s *sketch) index(h uint64, i int) uint64 {
+	return (h + uint64(i)*(h>>32|1)) & s.mask
+}
+
+func (s *sketch) add(key Key) {
+	h := s.hash(key)
+	for i, row := range s.rows {
+		if idx := s.index(h, i); row[idx] < 15 {
+			row[idx]++
+		}
+	}
+
+	if s.added++; s.added >= s.resetAt {
+		for _, row := range s.rows {
+			for j := range row {
+				row[j] /= 2
+			}
+		}
+		s.added /= 2
+	}
+}
+
+func (s *sketch) estimate(key Key) uint8 {
+	h := s.hash(key)
+	est := uint8(15)
+	for i, row := range s.rows {
+		est = min(est, row[s.index(h, i)])
+	}
+	return est
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func addr(i int) [][]byte {
+	return [][]byte{{10, 0, byte(i >> 8), byte(i)}}
+}
+
+func TestLRUEviction(t *testing.T) {
+	c := New(Options{MaxEntries: 3})
+	defer c.Close()
+
+	for i := range 3 {
+		c.Set(NewKey(fmt.Sprintf("host%d.test", i), 1, 1), addr(i), 300)
+	}
+	// host0 использовался недавно, вытесняется host1
+	c.Get(NewKey("host0.test", 1, 1))
+	c.Set(NewKey("host3.test", 1, 1), addr(3), 300)
+
+	if _, ok := c.Get(NewKey("host1.test", 1, 1)); ok {
+		t.Error("least recently used entry survived")
+	}
+	for _, name := range []string{"host0.test", "host2.test", "host3.test"} {
+		if _, ok := c.Get(NewKey(name, 1, 1)); !ok {
+			t.Errorf("%s evicted", name)
+		}
+	}
+	if st := c.Stats(); st.Entries != 3 || st.Evicted != 1 {
+		t.Errorf("expected 3 entries and 1 eviction, got %+v", st)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	one := RRset{Key: NewKey("host0.test", 1, 1), Records: addr(0)}.size()
+	c := New(Options{MaxBytes: 4 * one})
+	defer c.Close()
+
+	for i := range 10 {
+		c.Set(NewKey(fmt.Sprintf("host%d.test", i), 1, 1), addr(i), 300)
+	}
+	if st := c.Stats(); st.Bytes > 4*one || st.Entries != 4 || st.Evicted != 6 {
+		t.Errorf("budget of %d bytes not kept: %+v", 4*one, st)
+	}
+
+	c.Set(NewKey("huge.test", 16, 1), [][]byte{make([]byte, 8*one)}, 300)
+	if st := c.Stats(); st.Rejected != 1 || st.Entries != 4 {
+		t.Errorf("entry larger than the budget must be rejected: %+v", st)
+	}
+}
+
+func TestTinyLFUResistsScans(t *testing.T) {
+	c := New(Options{MaxEntries: 10, Policy: TinyLFU})
+	defer c.Close()
+
+	for i := range 10 {
+		key := NewKey(fmt.Sprintf("popular%d.test", i), 1, 1)
+		c.Set(key, addr(i), 300)
+		for range 5 {
+			c.Get(key)
+		}
+	}
+
+	// одноразовые имена не должны вытеснить популярные
+	for i := range 1000 {
+		key := NewKey(fmt.Sprintf("scan%d.test", i), 1, 1)
+		c.Get(key)
+		c.Set(key, addr(i), 300)
+	}
+
+	for i := range 10 {
+		if _, ok := c.Get(NewKey(fmt.Sprintf("popular%d.test", i), 1, 1)); !ok {
+			t.Errorf("popular%d.test was evicted by the scan", i)
+		}
+	}
+	if st := c.Stats(); st.Rejected == 0 {
+		t.Errorf("the admission filter rejected nothing: %+v", st)
+	}
+}
+
+func TestExpiredRemovedInBatches(t *testing.T) {
+	c := New(Options{Shards: 1})
+	defer c.Close()
+
+	for i := range expireBatch + 10 {
+		c.Set(NewKey(fmt.Sprintf("old%d.test", i), 1, 1), addr(i), 0)
+	}
+	c.Set(NewKey("fresh.test", 1, 1), addr(0), 300)
+
+	now := time.Now().Add(time.Millisecond)
+	if n := c.shards[0].expireSome(now); n != expireBatch {
+		t.Errorf("first batch removed %d entries, expected %d", n, expireBatch)
+	}
+	c.cleanExpired()
+
+	if st := c.Stats(); st.Entries != 1 || st.Expired != expireBatch+10 {
+		t.Errorf("expected only the fresh entry left, got %+v", st)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for name, want := range map[string]Policy{"": LRU, "lru": LRU, "tinylfu": TinyLFU} {
+		if p, err := ParsePolicy(name); err != nil || p != want {
+			t.Errorf("ParsePolicy(%q) = %q, %v", name, p, err)
+		}
+	}
+	if _, err := ParsePolicy("fifo"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,45 @@
+package cache
+
+import "time"
+
+const (
+	// prefetchQueue is how many refreshes can wait for a worker
+	prefetchQueue = 256
+	// prefetchFraction: an entry is refreshed in the last 1/prefetchFraction
+	// of its TTL
+	prefetchFraction = 10
+)
+
+// maybePrefetch queues a refresh of e when it is popular and in the last
+// tenth of its TTL, so it is replaced before clients start missing it. Only
+// positive answers are prefetched.
+func (sh *shard) maybePrefetch(e *entry, now time.Time) {
+	if sh.prefetchCh == nil || e.prefetching || e.rrset.Negative() || e.hits < sh.prefetchHits {
+		return
+	}
+
+	left := e.rrset.Exp.Sub(now)
+	if left <= 0 || left > e.ttl/prefetchFraction {
+		return
+	}
+
+	select {
+	case sh.prefetchCh <- e.rrset.Key:
+		e.prefetching = true
+		sh.stats.Prefetches++
+	default:
+		sh.stats.PrefetchDropped++
+	}
+}
+
+// prefetchDone ends the refresh of key. When it didn't replace the entry, the
+// refresh failed and the entry may be queued again.
+func (sh *shard) prefetchDone(key Key) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if e, ok := sh.cache[key]; ok && e.prefetching {
+		e.prefetching = false
+		sh.stats.PrefetchFailed++
+	}
+}
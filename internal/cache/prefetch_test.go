@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrefetchNearExpiry(t *testing.T) {
+	c := New(Options{PrefetchHits: 2})
+	defer c.Close()
+
+	key := NewKey("api.example.com", 1, 1)
+	c.set(RRset{Key: key, Records: addr(1), Exp: time.Now().Add(50 * time.Millisecond)})
+	// будто запись жила минуту и осталось меньше 10% TTL
+	c.shardFor(key).cache[key].ttl = time.Minute
+
+	c.Get(key)
+	select {
+	case <-c.Prefetches():
+		t.Fatal("entry asked for once was prefetched")
+	default:
+	}
+
+	c.Get(key)
+	c.Get(key)
+	select {
+	case got := <-c.Prefetches():
+		if got != key {
+			t.Fatalf("prefetch of %v, expected %v", got, key)
+		}
+	default:
+		t.Fatal("popular entry close to expiry was not prefetched")
+	}
+	if len(c.Prefetches()) != 0 {
+		t.Error("entry queued for prefetch twice")
+	}
+
+	// обновление пришло до истечения старой записи
+	c.Set(key, addr(2), 300)
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.Get(key); !ok {
+		t.Fatal("refreshed entry lost")
+	}
+
+	if st := c.Stats(); st.Prefetches != 1 || st.PrefetchSaved != 1 {
+		t.Errorf("expected one prefetch that saved a miss, got %+v", st)
+	}
+}
+
+func TestPrefetchRetriedAfterFailure(t *testing.T) {
+	c := New(Options{PrefetchHits: 1})
+	defer c.Close()
+
+	key := NewKey("api.example.com", 1, 1)
+	c.set(RRset{Key: key, Records: addr(1), Exp: time.Now().Add(time.Second)})
+	c.shardFor(key).cache[key].ttl = time.Minute
+
+	c.Get(key)
+	if got := <-c.Prefetches(); got != key {
+		t.Fatalf("prefetch of %v, expected %v", got, key)
+	}
+
+	// обновление не удалось, запись осталась старой
+	c.PrefetchDone(key)
+	c.Get(key)
+	select {
+	case <-c.Prefetches():
+	default:
+		t.Fatal("entry whose refresh failed was not prefetched again")
+	}
+
+	// успешное обновление уже сняло отметку, PrefetchDone ничего не считает
+	c.Set(key, addr(2), 300)
+	c.PrefetchDone(key)
+
+	if st := c.Stats(); st.Prefetches != 2 || st.PrefetchFailed != 1 {
+		t.Errorf("expected two prefetches and one failure, got %+v", st)
+	}
+}
+
+func TestPrefetchDisabled(t *testing.T) {
+	c := InitCache()
+	defer c.Close()
+
+	if c.Prefetches() != nil {
+		t.Error("prefetch queue exists without PrefetchHits")
+	}
+}
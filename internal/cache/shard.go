@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"math/bits"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Shards are never made smaller than this, a tiny share of the limits would
+// evict entries long before the cache as a whole is full.
+const (
+	minShardEntries = 64
+	minShardBytes   = 64 << 10
+)
+
+// shardCount returns the number of shards for opts, a power of two. Unless
+// set it is four per CPU.
+func shardCount(opts Options) int {
+	n := opts.Shards
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	n = 1 << bits.Len(uint(n-1))
+
+	for n > 1 && (opts.MaxEntries > 0 && opts.MaxEntries/n < minShardEntries || opts.MaxBytes > 0 && opts.MaxBytes/int64(n) < minShardBytes) {
+		n /= 2
+	}
+	return n
+}
+
+// entry is an RRset with its place in the recency list and the expiry heap.
+type entry struct {
+	rrset   RRset
+	size    int64
+	elem    *list.Element
+	heapIdx int
+
+	ttl         time.Duration // the whole TTL the RRset was stored with
+	hits        int
+	prefetching bool
+	savedAt     time.Time // expiry of the RRset a prefetch replaced
+}
+
+// shard is one lock's worth of the cache.
+type shard struct {
+	cache        map[Key]*entry
+	lru          *list.List // front is the most recently used
+	expiry       expiryHeap
+	sketch       *sketch // nil unless the policy is TinyLFU
+	maxEntries   int
+	maxBytes     int64
+	bytes        int64
+	stats        Stats
+	staleWindow  time.Duration
+	prefetchHits int
+	prefetchCh   chan Key
+	mtx          sync.Mutex
+}
+
+// newShard creates one of n shards, which splits the limits of opts evenly.
+func newShard(opts Options, n int, prefetchCh chan Key) *shard {
+	sh := &shard{
+		cache:        make(map[Key]*entry),
+		lru:          list.New(),
+		maxEntries:   (max(opts.MaxEntries, 0) + n - 1) / n,
+		maxBytes:     (max(opts.MaxBytes, 0) + int64(n) - 1) / int64(n),
+		staleWindow:  max(opts.StaleWindow, 0),
+		prefetchHits: opts.PrefetchHits,
+		prefetchCh:   prefetchCh,
+	}
+	if opts.Policy == TinyLFU {
+		sh.sketch = newSketch(sh.maxEntries)
+	}
+	return sh
+}
+
+func (sh *shard) set(rrset RRset) {
+	size := rrset.size()
+	ttl := time.Until(rrset.Exp)
+
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if e, ok := sh.cache[rrset.Key]; ok {
+		if e.prefetching {
+			e.savedAt = e.rrset.Exp
+		}
+		sh.bytes += size - e.size
+		e.rrset, e.size, e.ttl = rrset, size, ttl
+		e.hits, e.prefetching = 0, false
+		sh.lru.MoveToFront(e.elem)
+		heap.Fix(&sh.expiry, e.heapIdx)
+		sh.evict()
+		return
+	}
+
+	if !sh.admit(rrset.Key, size) {
+		sh.stats.Rejected++
+		return
+	}
+
+	e := &entry{rrset: rrset, size: size, ttl: ttl}
+	e.elem = sh.lru.PushFront(e)
+	heap.Push(&sh.expiry, e)
+	sh.cache[rrset.Key] = e
+	sh.bytes += size
+	sh.evict()
+}
+
+func (sh *shard) get(key Key, stale bool) (RRset, bool) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if sh.sketch != nil {
+		sh.sketch.add(key)
+	}
+
+	e, ok := sh.cache[key]
+	if !ok {
+		return RRset{}, false
+	}
+
+	now := time.Now()
+	if sh.dead(e, now) {
+		sh.remove(e)
+		sh.stats.Expired++
+		return RRset{}, false
+	}
+	if !stale && !e.rrset.Exp.After(now) {
+		return RRset{}, false
+	}
+
+	e.hits++
+	if !e.savedAt.IsZero() && now.After(e.savedAt) {
+		sh.stats.PrefetchSaved++
+		e.savedAt = time.Time{}
+	}
+	sh.maybePrefetch(e, now)
+
+	sh.lru.MoveToFront(e.elem)
+	return e.rrset, true
+}
+
+// dead reports whether e is past its stale window and can't be served at all.
+func (sh *shard) dead(e *entry, now time.Time) bool {
+	return !e.rrset.Exp.Add(sh.staleWindow).After(now)
+}
+
+// live returns the RRsets that can still be served.
+func (sh *shard) live(now time.Time) []RRset {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	rrsets := make([]RRset, 0, len(sh.cache))
+	for _, e := range sh.cache {
+		if !sh.dead(e, now) {
+			rrsets = append(rrsets, e.rrset)
+		}
+	}
+	return rrsets
+}
+
+func (sh *shard) statistics() Stats {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	stats := sh.stats
+	stats.Entries, stats.Bytes = len(sh.cache), sh.bytes
+	return stats
+}
+
+func (sh *shard) remove(e *entry) {
+	delete(sh.cache, e.rrset.Key)
+	sh.lru.Remove(e.elem)
+	heap.Remove(&sh.expiry, e.heapIdx)
+	sh.bytes -= e.size
+}
+
+// expireBatch is how many entries cleanExpired removes per lock, lookups get
+// the shard in between.
+const expireBatch = 128
+
+// cleanExpired removes the entries past their stale window, soonest first, a
+// batch at a time.
+func (sh *shard) cleanExpired() {
+	for {
+		if sh.expireSome(time.Now()) < expireBatch {
+			return
+		}
+	}
+}
+
+func (sh *shard) expireSome(now time.Time) int {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	n := 0
+	for ; n < expireBatch && len(sh.expiry) > 0 && sh.dead(sh.expiry[0], now); n++ {
+		sh.remove(sh.expiry[0])
+		sh.stats.Expired++
+	}
+	return n
+}
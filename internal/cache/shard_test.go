@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestShardCount(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want int
+	}{
+		{"explicit", Options{Shards: 8}, 8},
+		{"rounded up", Options{Shards: 5}, 8},
+		{"small entry limit", Options{Shards: 16, MaxEntries: 200}, 2},
+		{"small byte budget", Options{Shards: 16, MaxBytes: 100 << 10}, 1},
+		{"large limits", Options{Shards: 16, MaxEntries: 100000, MaxBytes: 64 << 20}, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := shardCount(tt.opts); n != tt.want {
+				t.Errorf("expected %d shards, got %d", tt.want, n)
+			}
+		})
+	}
+
+	if n := shardCount(Options{}); n < 4*runtime.GOMAXPROCS(0) {
+		t.Errorf("default %d shards for %d CPUs", n, runtime.GOMAXPROCS(0))
+	}
+}
+
+func TestShardsShareLimits(t *testing.T) {
+	c := New(Options{Shards: 4, MaxEntries: 1000})
+	defer c.Close()
+
+	for i := range 5000 {
+		c.Set(NewKey(fmt.Sprintf("host%d.test", i), 1, 1), addr(i), 300)
+	}
+
+	st := c.Stats()
+	if st.Entries > 1000 || st.Entries < 900 {
+		t.Errorf("expected close to 1000 entries over all shards, got %d", st.Entries)
+	}
+	if st.Evicted+uint64(st.Entries) != 5000 {
+		t.Errorf("evictions don't add up: %+v", st)
+	}
+}
+
+// benchCache fills a cache of the given shards with names entries.
+func benchCache(b *testing.B, shards, names int) (*Cache, []Key) {
+	c := New(Options{Shards: shards})
+	b.Cleanup(c.Close)
+
+	keys := make([]Key, names)
+	for i := range keys {
+		keys[i] = NewKey(fmt.Sprintf("host%d.example.com", i), 1, 1)
+		c.Set(keys[i], addr(i), 300)
+	}
+	return c, keys
+}
+
+// Запускать с -cpu 1,2,4,8: с одним шардом время на операцию не падает с
+// ростом числа ядер, с шардами падает.
+func BenchmarkGetParallel(b *testing.B) {
+	for _, shards := range []int{1, 0} {
+		b.Run(fmt.Sprintf("shards=%d", shardCount(Options{Shards: shards})), func(b *testing.B) {
+			c, keys := benchCache(b, shards, 10000)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.Get(keys[i%len(keys)])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMixedParallel(b *testing.B) {
+	for _, shards := range []int{1, 0} {
+		b.Run(fmt.Sprintf("shards=%d", shardCount(Options{Shards: shards})), func(b *testing.B) {
+			c, keys := benchCache(b, shards, 10000)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					key := keys[i%len(keys)]
+					if i%10 == 0 {
+						c.Set(key, addr(i), 300)
+						continue
+					}
+					c.Get(key)
+				}
+			})
+		})
+	}
+}
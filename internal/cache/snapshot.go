@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrBadSnapshot     = errors.New("not a cache snapshot")
+	ErrSnapshotVersion = errors.New("unsupported cache snapshot version")
+)
+
+// snapshotMagic starts every snapshot file, snapshotVersion changes whenever
+// the layout below does.
+const (
+	snapshotMagic   = "DNSC"
+	snapshotVersion = 1
+)
+
+// Save writes every entry that can still be served to w:
+//
+//	magic "DNSC", version uint16, saved at (unix nanoseconds) int64, count uint32
+//	per entry: name, type uint16, class uint16, TTL left (nanoseconds) int64,
+//	negative uint8, then rcode uint8, SOA owner and SOA RDATA of a negative
+//	entry or record count uint16 and records of a positive one
+//
+// Names and byte strings are prefixed with their uint16 length. The TTL left
+// is negative for stale entries.
+func (c *Cache) Save(w io.Writer) error {
+	now := time.Now()
+
+	var rrsets []RRset
+	for _, sh := range c.shards {
+		rrsets = append(rrsets, sh.live(now)...)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	binary.Write(bw, binary.BigEndian, uint16(snapshotVersion))
+	binary.Write(bw, binary.BigEndian, now.UnixNano())
+	binary.Write(bw, binary.BigEndian, uint32(len(rrsets)))
+
+	for _, rrset := range rrsets {
+		writeString(bw, rrset.Name)
+		binary.Write(bw, binary.BigEndian, rrset.Type)
+		binary.Write(bw, binary.BigEndian, rrset.Class)
+		binary.Write(bw, binary.BigEndian, int64(rrset.Exp.Sub(now)))
+		if rrset.Negative() {
+			bw.WriteByte(1)
+			bw.WriteByte(rrset.Rcode)
+			writeString(bw, rrset.SOAName)
+			writeBytes(bw, rrset.SOA)
+			continue
+		}
+
+		bw.WriteByte(0)
+		binary.Write(bw, binary.BigEndian, uint16(len(rrset.Records)))
+		for _, rec := range rrset.Records {
+			writeBytes(bw, rec)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Load adds the entries of a snapshot written by Save, taking off the TTL
+// that ran out since it was saved. Entries past their stale window are
+// skipped. It returns how many entries were read.
+func (c *Cache) Load(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, ErrBadSnapshot
+	}
+
+	var (
+		version uint16
+		savedAt int64
+		count   uint32
+	)
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if version != snapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrSnapshotVersion, version)
+	}
+	if err := binary.Read(br, binary.BigEndian, &savedAt); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(time.Unix(0, savedAt))
+
+	for i := range count {
+		rrset, left, err := readEntry(br)
+		if err != nil {
+			return int(i), fmt.Errorf("%w: entry %d: %v", ErrBadSnapshot, i, err)
+		}
+
+		rrset.Exp = now.Add(left - elapsed)
+		if sh := c.shardFor(rrset.Key); !sh.dead(&entry{rrset: rrset}, now) {
+			sh.set(rrset)
+		}
+	}
+
+	return int(count), nil
+}
+
+func readEntry(br *bufio.Reader) (RRset, time.Duration, error) {
+	var (
+		rrset    RRset
+		left     int64
+		negative uint8
+		n        uint16
+		err      error
+	)
+
+	if rrset.Name, err = readString(br); err != nil {
+		return RRset{}, 0, err
+	}
+	for _, v := range []any{&rrset.Type, &rrset.Class, &left, &negative} {
+		if err := binary.Read(br, binary.BigEndian, v); err != nil {
+			return RRset{}, 0, err
+		}
+	}
+
+	if negative == 1 {
+		if rrset.Rcode, err = br.ReadByte(); err != nil {
+			return RRset{}, 0, err
+		}
+		if rrset.SOAName, err = readString(br); err != nil {
+			return RRset{}, 0, err
+		}
+		if rrset.SOA, err = readBytes(br); err != nil {
+			return RRset{}, 0, err
+		}
+		return rrset, time.Duration(left), nil
+	}
+
+	if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+		return RRset{}, 0, err
+	}
+	for range n {
+		rec, err := readBytes(br)
+		if err != nil {
+			return RRset{}, 0, err
+		}
+		rrset.Records = append(rrset.Records, rec)
+	}
+
+	if len(rrset.Records) == 0 {
+		return RRset{}, 0, errors.New("entry has no records")
+	}
+	return rrset, time.Duration(left), nil
+}
+
+// SaveFile writes a snapshot to path. The file is replaced at once, a crash
+// while saving leaves the previous snapshot in place.
+func (c *Cache) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := c.Save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile loads the snapshot saved at path.
+func (c *Cache) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return c.Load(f)
+}
+
+func writeString(w *bufio.Writer, s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+func writeBytes(w *bufio.Writer, b []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(b)))
+	w.Write(b)
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	b, err := readBytes(r)
+	return string(b), err
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := New(Options{StaleWindow: time.Hour})
+	defer c.Close()
+
+	c.Set(NewKey("example.com", 1, 1), [][]byte{{10, 0, 0, 1}, {10, 0, 0, 2}}, 300)
+	c.Set(NewKey("stale.example.com", 1, 1), addr(3), 0)
+	c.SetNegative(NXDomainKey("missing.example.com", 1), 3, "example.com", []byte{1, 2, 3}, 600)
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if err := c.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+
+	loaded := New(Options{StaleWindow: time.Hour})
+	defer loaded.Close()
+	if n, err := loaded.LoadFile(path); err != nil || n != 3 {
+		t.Fatalf("LoadFile: %d entries, %v", n, err)
+	}
+
+	if rrset, ok := loaded.Get(NewKey("example.com", 1, 1)); !ok || len(rrset.Records) != 2 {
+		t.Errorf("positive entry lost: %+v", rrset)
+	}
+	if _, ok := loaded.GetStale(NewKey("stale.example.com", 1, 1)); !ok {
+		t.Error("stale entry lost")
+	}
+	rrset, ok := loaded.Get(NXDomainKey("missing.example.com", 1))
+	if !ok || rrset.Rcode != 3 || rrset.SOAName != "example.com" || !bytes.Equal(rrset.SOA, []byte{1, 2, 3}) {
+		t.Errorf("negative entry lost: %+v", rrset)
+	}
+
+	// без окна устаревания истёкшая запись не загружается
+	strict := InitCache()
+	defer strict.Close()
+	strict.LoadFile(path)
+	if st := strict.Stats(); st.Entries != 2 {
+		t.Errorf("expected the expired entry skipped, got %+v", st)
+	}
+}
+
+func TestSnapshotTTLAdjusted(t *testing.T) {
+	c := InitCache()
+	defer c.Close()
+	c.Set(NewKey("example.com", 1, 1), addr(1), 300)
+	c.Set(NewKey("short.example.com", 1, 1), addr(2), 60)
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// снимок будто сделан 100 секунд назад
+	snap := buf.Bytes()
+	savedAt := int64(binary.BigEndian.Uint64(snap[6:14]))
+	binary.BigEndian.PutUint64(snap[6:14], uint64(savedAt-int64(100*time.Second)))
+
+	loaded := InitCache()
+	defer loaded.Close()
+	if _, err := loaded.Load(bytes.NewReader(snap)); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	rrset, ok := loaded.Get(NewKey("example.com", 1, 1))
+	if left := time.Until(rrset.Exp); !ok || left > 200*time.Second || left < 195*time.Second {
+		t.Errorf("expected about 200s left, got %v", left)
+	}
+	if _, ok := loaded.Get(NewKey("short.example.com", 1, 1)); ok {
+		t.Error("entry that expired while the server was down was loaded")
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	c := InitCache()
+	defer c.Close()
+
+	var buf bytes.Buffer
+	c.Save(&buf)
+	snap := buf.Bytes()
+	binary.BigEndian.PutUint16(snap[4:6], snapshotVersion+1)
+
+	if _, err := c.Load(bytes.NewReader(snap)); !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("expected ErrSnapshotVersion, got %v", err)
+	}
+	if _, err := c.Load(bytes.NewReader([]byte("garbage"))); !errors.Is(err, ErrBadSnapshot) {
+		t.Errorf("expected ErrBadSnapshot, got %v", err)
+	}
+}
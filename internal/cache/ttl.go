@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/suffix"
+)
+
+var ErrBadOverride = errors.New("bad TTL override")
+
+// TTL returns the seconds left before the RRset expires, rounded up, and 0
+// once it has.
+func (r RRset) TTL() uint32 {
+	left := time.Until(r.Exp)
+	if left <= 0 {
+		return 0
+	}
+	return uint32((left + time.Second - 1) / time.Second)
+}
+
+// ParseTTLOverrides reads comma separated "suffix=duration" pairs, such as
+// "api.example.com=30s,corp.example=1h".
+func ParseTTLOverrides(spec string) (map[string]time.Duration, error) {
+	overrides := make(map[string]time.Duration)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		suffix, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(suffix) == "" {
+			return nil, fmt.Errorf("%w: %q, expected suffix=duration", ErrBadOverride, pair)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("%w: %q: bad duration", ErrBadOverride, pair)
+		}
+		overrides[strings.TrimSpace(suffix)] = ttl
+	}
+	return overrides, nil
+}
+
+// newOverrides puts overrides into a suffix table, nil when there are none.
+func newOverrides(overrides map[string]time.Duration) *suffix.Table[time.Duration] {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	table := suffix.NewTable[time.Duration]()
+	for name, ttl := range overrides {
+		table.Add(name, ttl)
+	}
+	return table
+}
+
+// ttlFor returns how long the RRset of key is kept when the upstream gave it
+// ttl seconds: the override of the longest matching suffix if there is one,
+// otherwise ttl within [minTTL, maxTTL]. Denials are capped by
+// negativeTTLMax instead, overridden or not.
+func (c *Cache) ttlFor(key Key, ttl uint32, negative bool) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if c.overrides != nil {
+		if o, _, ok := c.overrides.Lookup(key.Name); ok {
+			if negative {
+				return min(o, c.negativeTTLMax)
+			}
+			return o
+		}
+	}
+
+	if negative {
+		return min(d, c.negativeTTLMax)
+	}
+	if c.maxTTL > 0 {
+		d = min(d, c.maxTTL)
+	}
+	return max(d, c.minTTL)
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTTLClamps(t *testing.T) {
+	c := New(Options{
+		MinTTL:         time.Minute,
+		MaxTTL:         time.Hour,
+		NegativeTTLMax: 5 * time.Minute,
+		TTLOverrides:   map[string]time.Duration{"example.com": 10 * time.Second, "api.example.com": 2 * time.Hour},
+	})
+	defer c.Close()
+
+	tests := []struct {
+		name     string
+		ttl      uint32
+		negative bool
+		want     time.Duration
+	}{
+		{"short.test", 5, false, time.Minute},
+		{"long.test", 86400, false, time.Hour},
+		{"normal.test", 300, false, 5 * time.Minute},
+		{"www.example.com", 300, false, 10 * time.Second},
+		// самый длинный суффикс важнее ограничений
+		{"v1.api.example.com", 300, false, 2 * time.Hour},
+		{"missing.test", 3600, true, 5 * time.Minute},
+		{"missing.example.com", 3600, true, 10 * time.Second},
+		// переопределение не продлевает отрицательный ответ дольше NegativeTTLMax
+		{"missing.api.example.com", 60, true, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.ttlFor(NewKey(tt.name, 1, 1), tt.ttl, tt.negative); got != tt.want {
+				t.Errorf("TTL %ds became %v, expected %v", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRRsetTTLCountsDown(t *testing.T) {
+	c := InitCache()
+	defer c.Close()
+
+	c.Set(NewKey("example.com", 1, 1), addr(1), 300)
+	rrset, _ := c.Get(NewKey("example.com", 1, 1))
+	if ttl := rrset.TTL(); ttl != 300 {
+		t.Errorf("fresh RRset has TTL %d, expected 300", ttl)
+	}
+
+	rrset.Exp = time.Now().Add(42*time.Second + 500*time.Millisecond)
+	if ttl := rrset.TTL(); ttl != 43 {
+		t.Errorf("expected 43 seconds left, got %d", ttl)
+	}
+	rrset.Exp = time.Now().Add(-time.Second)
+	if ttl := rrset.TTL(); ttl != 0 {
+		t.Errorf("expired RRset has TTL %d", ttl)
+	}
+}
+
+func TestParseTTLOverrides(t *testing.T) {
+	got, err := ParseTTLOverrides("api.example.com=30s, corp.example = 1h,")
+	if err != nil {
+		t.Fatalf("ParseTTLOverrides: %v", err)
+	}
+	if len(got) != 2 || got["api.example.com"] != 30*time.Second || got["corp.example"] != time.Hour {
+		t.Errorf("unexpected overrides %v", got)
+	}
+
+	for _, bad := range []string{"example.com", "=30s", "example.com=soon", "example.com=-1s"} {
+		if _, err := ParseTTLOverrides(bad); !errors.Is(err, ErrBadOverride) {
+			t.Errorf("%q: expected ErrBadOverride, got %v", bad, err)
+		}
+	}
+}
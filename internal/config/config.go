@@ -0,0 +1,314 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRateLimit      = 20
+	DefaultListenHost     = "0.0.0.0"
+	DefaultTCPIdleTimeout = 10 * time.Second
+	DefaultTCPMaxQueries  = 100
+	DefaultEDNSUDPSize    = 1232
+	DefaultTLSIdleTimeout = 30 * time.Second
+	DefaultDoHPath        = "/dns-query"
+	DefaultUpstreams      = "udp://1.1.1.1:53,tls://8.8.8.8:853,udp://8.8.4.4:53"
+
+	DefaultUpstreamTimeout       = 5 * time.Second
+	DefaultUpstreamFailThreshold = 3
+	DefaultUpstreamCooldown      = 30 * time.Second
+	DefaultUpstreamProbeInterval = 10 * time.Second
+
+	DefaultNegativeTTLMax  = time.Hour
+	DefaultCacheMaxEntries = 100000
+
+	DefaultStaleAnswerTimeout = 1800 * time.Millisecond
+
+	DefaultPrefetchHits    = 3
+	DefaultPrefetchWorkers = 4
+
+	DefaultCacheSnapshotInterval = 5 * time.Minute
+)
+
+type Config struct {
+	ListenHost     string
+	UDPPort        int
+	TCPPort        int
+	RateLimit      int
+	TCPIdleTimeout time.Duration
+	TCPMaxQueries  int
+	EDNSUDPSize    int
+	Upstreams      string // comma separated udp://, tcp://, tls:// or https:// URLs
+
+	UpstreamStrategy      string // sequential, round_robin, random or lowest_latency
+	UpstreamTimeout       time.Duration
+	UpstreamFailThreshold int
+	UpstreamCooldown      time.Duration
+	UpstreamProbeInterval time.Duration
+	UpstreamParallel      int           // upstreams raced for every query
+	UpstreamHedgeDelay    time.Duration // 0 disables hedging
+
+	// conditional forwarding, "suffix upstreams [nocache]" rules that take
+	// precedence over Upstreams
+	ForwardRules     string // rules separated by ";"
+	ForwardRulesFile string // one rule per line
+
+	// resolve iteratively from the root servers instead of forwarding to
+	// Upstreams; forwarding rules still apply
+	Recursive bool
+	RootHints string // comma separated root server addresses, the IANA roots if empty
+
+	NegativeTTLMax  time.Duration // longest time NXDOMAIN and NODATA answers are cached
+	CacheMaxEntries int           // 0 - unlimited
+	CacheMaxBytes   int           // approximate memory budget, 0 - unlimited
+	CachePolicy     string        // lru or tinylfu
+	CacheShards     int           // 0 - four per CPU
+
+	// TTLs given by upstreams are clamped to [MinTTL, MaxTTL] before caching,
+	// names under a suffix of TTLOverrides ("suffix=duration,...") get its TTL
+	MinTTL       time.Duration
+	MaxTTL       time.Duration // 0 - no limit
+	TTLOverrides string
+
+	// serve-stale (RFC 8767): expired answers kept for StaleWindow are served
+	// when the upstreams fail or take longer than StaleAnswerTimeout
+	StaleWindow        time.Duration // 0 disables
+	StaleAnswerTimeout time.Duration
+	Offline            bool // answer from the cache only, never ask the upstreams
+
+	// entries asked for PrefetchHits times are refreshed in the last 10% of
+	// their TTL by PrefetchWorkers goroutines
+	PrefetchHits    int // 0 disables
+	PrefetchWorkers int
+
+	// the cache is saved to CacheSnapshotFile every CacheSnapshotInterval and
+	// on shutdown, and loaded from it at startup
+	CacheSnapshotFile     string // empty disables
+	CacheSnapshotInterval time.Duration
+	Warmup                string // comma separated names resolved at startup
+
+	// DNS-over-TLS, disabled while TLSPort is 0
+	TLSPort         int
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string // clients must present a certificate signed by this CA if set
+	TLSIdleTimeout  time.Duration
+
+	// DNS-over-HTTPS, disabled while DoHPort is 0. Shares the TLS certificate.
+	DoHPort int
+	DoHPath string
+
+	// DNS-over-QUIC, disabled while QUICPort is 0. Shares the TLS certificate.
+	QUICPort int
+}
+
+func Load() (*Config, error) {
+	cfg := &Config{
+		ListenHost:     DefaultListenHost,
+		RateLimit:      DefaultRateLimit,
+		TCPIdleTimeout: DefaultTCPIdleTimeout,
+		TCPMaxQueries:  DefaultTCPMaxQueries,
+		EDNSUDPSize:    DefaultEDNSUDPSize,
+		TLSIdleTimeout: DefaultTLSIdleTimeout,
+		DoHPath:        DefaultDoHPath,
+		Upstreams:      DefaultUpstreams,
+
+		UpstreamTimeout:       DefaultUpstreamTimeout,
+		UpstreamFailThreshold: DefaultUpstreamFailThreshold,
+		UpstreamCooldown:      DefaultUpstreamCooldown,
+		UpstreamProbeInterval: DefaultUpstreamProbeInterval,
+
+		NegativeTTLMax:  DefaultNegativeTTLMax,
+		CacheMaxEntries: DefaultCacheMaxEntries,
+
+		StaleAnswerTimeout: DefaultStaleAnswerTimeout,
+
+		PrefetchHits:    DefaultPrefetchHits,
+		PrefetchWorkers: DefaultPrefetchWorkers,
+
+		CacheSnapshotInterval: DefaultCacheSnapshotInterval,
+	}
+
+	if host := os.Getenv("listen_host"); host != "" {
+		cfg.ListenHost = host
+	}
+
+	port, err := strconv.Atoi(os.Getenv("udp_port"))
+	if err != nil {
+		return nil, fmt.Errorf("udp_port: %w", err)
+	}
+	cfg.UDPPort = port
+	cfg.TCPPort = port
+
+	if cfg.TCPPort, err = envInt("tcp_port", cfg.TCPPort); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit, err = envInt("rate_limit", cfg.RateLimit); err != nil {
+		return nil, err
+	}
+	if cfg.TCPIdleTimeout, err = envDuration("tcp_idle_timeout", cfg.TCPIdleTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.TCPIdleTimeout <= 0 {
+		return nil, fmt.Errorf("tcp_idle_timeout must be positive, got %v", cfg.TCPIdleTimeout)
+	}
+	if cfg.TCPMaxQueries, err = envInt("tcp_max_queries", cfg.TCPMaxQueries); err != nil {
+		return nil, err
+	}
+	if cfg.EDNSUDPSize, err = envInt("edns_udp_size", cfg.EDNSUDPSize); err != nil {
+		return nil, err
+	}
+
+	if upstreams := os.Getenv("upstreams"); upstreams != "" {
+		cfg.Upstreams = upstreams
+	}
+	cfg.UpstreamStrategy = os.Getenv("upstream_strategy")
+	if cfg.UpstreamTimeout, err = envDuration("upstream_timeout", cfg.UpstreamTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamFailThreshold, err = envInt("upstream_fail_threshold", cfg.UpstreamFailThreshold); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamCooldown, err = envDuration("upstream_cooldown", cfg.UpstreamCooldown); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamProbeInterval, err = envDuration("upstream_probe_interval", cfg.UpstreamProbeInterval); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamParallel, err = envInt("upstream_parallel", 1); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamHedgeDelay, err = envDuration("upstream_hedge_delay", 0); err != nil {
+		return nil, err
+	}
+
+	cfg.ForwardRules = os.Getenv("forward_rules")
+	cfg.ForwardRulesFile = os.Getenv("forward_rules_file")
+
+	if cfg.Recursive, err = envBool("recursive", false); err != nil {
+		return nil, err
+	}
+	cfg.RootHints = os.Getenv("root_hints")
+
+	if cfg.NegativeTTLMax, err = envDuration("negative_ttl_max", cfg.NegativeTTLMax); err != nil {
+		return nil, err
+	}
+	if cfg.CacheMaxEntries, err = envInt("cache_max_entries", cfg.CacheMaxEntries); err != nil {
+		return nil, err
+	}
+	if cfg.CacheMaxBytes, err = envInt("cache_max_bytes", 0); err != nil {
+		return nil, err
+	}
+	cfg.CachePolicy = os.Getenv("cache_policy")
+	if cfg.CacheShards, err = envInt("cache_shards", 0); err != nil {
+		return nil, err
+	}
+
+	if cfg.MinTTL, err = envDuration("min_ttl", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxTTL, err = envDuration("max_ttl", 0); err != nil {
+		return nil, err
+	}
+	cfg.TTLOverrides = os.Getenv("ttl_overrides")
+
+	if cfg.StaleWindow, err = envDuration("stale_window", 0); err != nil {
+		return nil, err
+	}
+	if cfg.StaleAnswerTimeout, err = envDuration("stale_answer_timeout", cfg.StaleAnswerTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.Offline, err = envBool("offline", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.PrefetchHits, err = envInt("prefetch_hits", cfg.PrefetchHits); err != nil {
+		return nil, err
+	}
+	if cfg.PrefetchWorkers, err = envInt("prefetch_workers", cfg.PrefetchWorkers); err != nil {
+		return nil, err
+	}
+
+	cfg.CacheSnapshotFile = os.Getenv("cache_snapshot_file")
+	if cfg.CacheSnapshotInterval, err = envDuration("cache_snapshot_interval", cfg.CacheSnapshotInterval); err != nil {
+		return nil, err
+	}
+	cfg.Warmup = os.Getenv("warmup")
+
+	if cfg.TLSPort, err = envInt("tls_port", 0); err != nil {
+		return nil, err
+	}
+	cfg.TLSCertFile = os.Getenv("tls_cert_file")
+	cfg.TLSKeyFile = os.Getenv("tls_key_file")
+	cfg.TLSClientCAFile = os.Getenv("tls_client_ca_file")
+	if cfg.TLSIdleTimeout, err = envDuration("tls_idle_timeout", cfg.TLSIdleTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.TLSIdleTimeout <= 0 {
+		return nil, fmt.Errorf("tls_idle_timeout must be positive, got %v", cfg.TLSIdleTimeout)
+	}
+
+	if cfg.DoHPort, err = envInt("doh_port", 0); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("doh_path"); path != "" {
+		// ServeMux panics on a pattern it can't parse
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t{}") {
+			return nil, fmt.Errorf("doh_path must be a URL path starting with /, got %q", path)
+		}
+		cfg.DoHPath = path
+	}
+
+	if cfg.QUICPort, err = envInt("quic_port", 0); err != nil {
+		return nil, err
+	}
+
+	if (cfg.TLSPort != 0 || cfg.DoHPort != 0 || cfg.QUICPort != 0) && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("tls_cert_file and tls_key_file are required for DNS-over-TLS, HTTPS and QUIC")
+	}
+
+	return cfg, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrBadRule = errors.New("bad forwarding rule")
+
+// Rule sends queries for names under Suffix to the upstream group Upstreams,
+// a comma separated list of upstream URLs.
+type Rule struct {
+	Suffix    string
+	Upstreams string
+	NoCache   bool // answers are passed through without being cached
+}
+
+// ParseRules reads one rule per line:
+//
+//	corp.example.  udp://10.0.0.1:53,udp://10.0.0.2:53  nocache
+//
+// Blank lines and lines starting with # are skipped.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%w on line %d: expected suffix, upstreams and an optional nocache", ErrBadRule, line)
+		}
+
+		rule := Rule{Suffix: fields[0], Upstreams: fields[1]}
+		if len(fields) == 3 {
+			if fields[2] != "nocache" {
+				return nil, fmt.Errorf("%w on line %d: unknown option %q", ErrBadRule, line, fields[2])
+			}
+			rule.NoCache = true
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadRules collects the rules from inline, where rules are separated by
+// semicolons, followed by the ones in file. Either may be empty.
+func LoadRules(inline, file string) ([]Rule, error) {
+	rules, err := ParseRules(strings.NewReader(strings.ReplaceAll(inline, ";", "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	if file == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fromFile, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return append(rules, fromFile...), nil
+}
@@ -0,0 +1,32 @@
+package forward
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# внутренние зоны
+corp.example.    udp://10.0.0.1:53,udp://10.0.0.2:53 nocache
+10.in-addr.arpa  tcp://10.0.0.1:53
+`))
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+
+	want := []Rule{
+		{Suffix: "corp.example.", Upstreams: "udp://10.0.0.1:53,udp://10.0.0.2:53", NoCache: true},
+		{Suffix: "10.in-addr.arpa", Upstreams: "tcp://10.0.0.1:53"},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(want) {
+		t.Errorf("got %v, expected %v", rules, want)
+	}
+
+	for _, bad := range []string{"corp.example", "corp.example udp://10.0.0.1 cache", "a b c d"} {
+		if _, err := ParseRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rejection is a record Scrub refused, with the reason why.
+type Rejection struct {
+	Section string
+	Record  ResourceRecord
+	Reason  string
+}
+
+func (r Rejection) String() string {
+	return fmt.Sprintf("%s %s type %d: %s", r.Section, r.Record.Name, r.Record.Type, r.Reason)
+}
+
+// InBailiwick reports whether name is zone or a subdomain of it. The
+// comparison ignores case.
+func InBailiwick(name, zone string) bool {
+	name, zone = strings.ToLower(strings.TrimSuffix(name, ".")), strings.ToLower(strings.TrimSuffix(zone, "."))
+	if zone == "" || name == zone {
+		return true
+	}
+	return strings.HasSuffix(name, "."+zone)
+}
+
+// CheckRDATA validates the RDATA length of the types whose size is fixed.
+func CheckRDATA(rr ResourceRecord) error {
+	want := 0
+	switch rr.Type {
+	case A:
+		want = 4
+	case AAAA:
+		want = 16
+	default:
+		return nil
+	}
+
+	if len(rr.Data) != want {
+		return fmt.Errorf("RDLENGTH %d, expected %d", len(rr.Data), want)
+	}
+	return nil
+}
+
+// Scrub sanity-checks an upstream response before anything from it is cached.
+// Answer records are accepted only when their owner is the question name or a
+// name reached from it through the CNAMEs of the answer, their class matches
+// the question and their RDATA is well formed. Additional records are kept in
+// resp only for the names of that chain and for the servers, mail exchangers
+// and targets named by the accepted answers and by the NS records of the zone
+// that answered.
+func Scrub(resp *Msg) ([]ResourceRecord, []Rejection, error) {
+	if len(resp.Question) != 1 {
+		return nil, nil, fmt.Errorf("%w: expected one question, got %d", ErrFormatError, len(resp.Question))
+	}
+	qname, qclass := resp.Question[0].Name, resp.Question[0].Class
+
+	// the CNAMEs can come in any order, follow them until nothing new is found
+	chain := map[string]bool{strings.ToLower(qname): true}
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range resp.Answer {
+			if rr.Type != CNAME || !chain[strings.ToLower(rr.Name)] {
+				continue
+			}
+			target, err := rr.Target()
+			if err != nil {
+				return nil, nil, err
+			}
+			if target = strings.ToLower(target); !chain[target] {
+				chain[target], grown = true, true
+			}
+		}
+	}
+
+	var (
+		accepted []ResourceRecord
+		rejected []Rejection
+	)
+	for _, rr := range resp.Answer {
+		reason := ""
+		switch {
+		case !chain[strings.ToLower(rr.Name)]:
+			reason = "out of bailiwick of " + qname
+		case rr.Class != qclass:
+			reason = fmt.Sprintf("class %d, question has %d", rr.Class, qclass)
+		default:
+			if err := CheckRDATA(rr); err != nil {
+				reason = err.Error()
+			}
+		}
+
+		if reason != "" {
+			rejected = append(rejected, Rejection{Section: "answer", Record: rr, Reason: reason})
+			continue
+		}
+		accepted = append(accepted, rr)
+	}
+
+	// glue is only wanted for names something accepted points to; letting a
+	// whole zone through would let "com NS ..." carry any *.com record
+	wanted := make(map[string]bool, len(chain))
+	for name := range chain {
+		wanted[name] = true
+	}
+	for _, rr := range accepted {
+		if target, ok := glueTarget(rr); ok {
+			wanted[target] = true
+		}
+	}
+	for _, rr := range resp.Authority {
+		if rr.Type != NS {
+			continue
+		}
+		for name := range chain {
+			if InBailiwick(name, rr.Name) {
+				if target, ok := glueTarget(rr); ok {
+					wanted[target] = true
+				}
+				break
+			}
+		}
+	}
+
+	additional := resp.Additional[:0]
+	for _, rr := range resp.Additional {
+		if rr.Type != OPT && !wanted[strings.ToLower(strings.TrimSuffix(rr.Name, "."))] {
+			rejected = append(rejected, Rejection{Section: "additional", Record: rr, Reason: "out of zone"})
+			continue
+		}
+		if err := CheckRDATA(rr); err != nil {
+			rejected = append(rejected, Rejection{Section: "additional", Record: rr, Reason: err.Error()})
+			continue
+		}
+		additional = append(additional, rr)
+	}
+	resp.Additional = additional
+
+	return accepted, rejected, nil
+}
+
+// glueTarget returns the lowercased name that the RDATA of an NS, MX, SRV or
+// CNAME record points to.
+func glueTarget(rr ResourceRecord) (string, bool) {
+	switch rr.Type {
+	case NS, MX, SRV, CNAME:
+	default:
+		return "", false
+	}
+
+	prefix, _ := rdataNames(rr.Type)
+	if len(rr.Data) < prefix {
+		return "", false
+	}
+	name, _, err := readName(rr.Data, prefix, rr.Data)
+	if err != nil {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimSuffix(name, ".")), true
+}
+
+// appendName writes name to msg as uncompressed labels.
+func appendName(msg []byte, name string) []byte {
+	if name != "" {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0)
+}
@@ -0,0 +1,117 @@
+package message
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func appendRR(msg []byte, name string, typ QType, data []byte) []byte {
+	msg = appendName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(typ))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(IN))
+	msg = binary.BigEndian.AppendUint32(msg, 300)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+// poisonedResponse answers www.example.com through a CNAME and carries
+// records an attacker would like to get cached.
+func poisonedResponse() []byte {
+	resp := []byte{0xAB, 0xCD, 0x81, 0x80, 0, 1, 0, 4, 0, 2, 0, 5}
+	resp = appendName(resp, "www.example.com")
+	resp = append(resp, 0, 1, 0, 1)
+
+	resp = appendRR(resp, "www.example.com", CNAME, appendName(nil, "cdn.example.net"))
+	resp = appendRR(resp, "cdn.example.net", A, []byte{10, 0, 0, 1})
+	resp = appendRR(resp, "bank.com", A, []byte{6, 6, 6, 6})
+	resp = appendRR(resp, "cdn.example.net", A, []byte{10, 0, 0, 2, 0})
+
+	resp = appendRR(resp, "example.com", NS, appendName(nil, "ns1.example.com"))
+	// NS зоны com не должен открывать дорогу любым записям *.com
+	resp = appendRR(resp, "com", NS, appendName(nil, "a.gtld-servers.net"))
+
+	resp = appendRR(resp, "ns1.example.com", A, []byte{10, 0, 0, 53})
+	resp = appendRR(resp, "ns.bank.com", A, []byte{6, 6, 6, 6})
+	resp = appendRR(resp, "mail.example.com", A, []byte{6, 6, 6, 6})
+	resp = appendRR(resp, "a.gtld-servers.net", A, []byte{192, 5, 6, 30})
+	return appendRR(resp, "", OPT, nil)
+}
+
+func TestScrub(t *testing.T) {
+	var resp Msg
+	if err := resp.Unpack(poisonedResponse()); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	answers, rejected, err := Scrub(&resp)
+	if err != nil {
+		t.Fatalf("Scrub: %v", err)
+	}
+
+	if len(answers) != 2 || answers[0].Type != CNAME || answers[1].Name != "cdn.example.net" {
+		t.Errorf("expected the CNAME and its target's address, got %+v", answers)
+	}
+
+	reasons := map[string]bool{}
+	for _, r := range rejected {
+		reasons[r.Section+" "+r.Record.Name] = true
+	}
+	for _, want := range []string{"answer bank.com", "answer cdn.example.net", "additional ns.bank.com", "additional mail.example.com"} {
+		if !reasons[want] {
+			t.Errorf("%s was not rejected (%v)", want, rejected)
+		}
+	}
+
+	if len(resp.Additional) != 3 {
+		t.Fatalf("expected 3 additional records, got %d", len(resp.Additional))
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	var again Msg
+	if err := again.Unpack(out); err != nil {
+		t.Fatalf("scrubbed message doesn't parse: %v", err)
+	}
+	if _, rejected, _ := Scrub(&again); len(rejected) != 2 {
+		t.Errorf("additional section still has out-of-zone records: %v", rejected)
+	}
+	if opt, err := again.EDNS(); err != nil || opt == nil {
+		t.Errorf("OPT record lost: %v", err)
+	}
+}
+
+func TestInBailiwick(t *testing.T) {
+	tests := []struct {
+		name, zone string
+		want       bool
+	}{
+		{"example.com", "example.com", true},
+		{"WWW.Example.com.", "example.com", true},
+		{"badexample.com", "example.com", false},
+		{"example.com", "www.example.com", false},
+		{"anything", "", true},
+	}
+
+	for _, tt := range tests {
+		if got := InBailiwick(tt.name, tt.zone); got != tt.want {
+			t.Errorf("InBailiwick(%q, %q) = %v", tt.name, tt.zone, got)
+		}
+	}
+}
+
+func TestReadNameRejectsPointerLoop(t *testing.T) {
+	msg := append(append([]byte(nil), exampleQuery[:12]...), 0xC0, 12)
+
+	if _, _, err := readName(msg, 12, msg); err == nil {
+		t.Error("self-referencing pointer was accepted")
+	}
+
+	// указатель на первую метку того же имени зацикливал разбор
+	loop := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'a', 'b', 'c', 0xC0, 0x0C, 0, 1, 0, 1}
+	var m Msg
+	if err := m.Unpack(loop); err == nil {
+		t.Error("pointer back to the start of the name was accepted")
+	}
+}
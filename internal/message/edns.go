@@ -0,0 +1,87 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MinUDPSize is the payload size every DNS client accepts (RFC 1035 4.2.1).
+	MinUDPSize = 512
+
+	doBit = 1 << 15
+)
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// EDNS holds the fields of the OPT pseudo-record (RFC 6891 6.1).
+type EDNS struct {
+	UDPSize  uint16
+	ExtRcode uint8 // upper 8 bits of the 12-bit RCODE
+	Version  uint8
+	DO       bool // DNSSEC OK
+	Options  []EDNSOption
+}
+
+// parseOPT decodes the fields and options of an OPT record.
+func parseOPT(rr ResourceRecord) (*EDNS, error) {
+	if rr.Name != "" {
+		return nil, fmt.Errorf("%w: OPT owner is not the root", ErrFormatError)
+	}
+
+	opt := &EDNS{
+		UDPSize:  uint16(rr.Class),
+		ExtRcode: uint8(rr.TTL >> 24),
+		Version:  uint8(rr.TTL >> 16),
+		DO:       rr.TTL&doBit != 0,
+	}
+
+	data := rr.Data
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: truncated EDNS option", ErrFormatError)
+		}
+		code := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if 4+length > len(data) {
+			return nil, fmt.Errorf("%w: truncated EDNS option", ErrFormatError)
+		}
+		opt.Options = append(opt.Options, EDNSOption{
+			Code: code,
+			Data: append([]byte(nil), data[4:4+length]...),
+		})
+		data = data[4+length:]
+	}
+
+	return opt, nil
+}
+
+// PayloadSize returns the largest UDP reply the sender of opt accepts, but no
+// more than limit. Clients without EDNS get the classic 512 bytes.
+func (o *EDNS) PayloadSize(limit int) int {
+	if o == nil || int(o.UDPSize) <= MinUDPSize {
+		return MinUDPSize
+	}
+	return min(int(o.UDPSize), max(limit, MinUDPSize))
+}
+
+// Record returns the OPT pseudo-record carrying o.
+func (o *EDNS) Record() ResourceRecord {
+	ttl := uint32(o.ExtRcode)<<24 | uint32(o.Version)<<16
+	if o.DO {
+		ttl |= doBit
+	}
+
+	var rdata []byte
+	for _, option := range o.Options {
+		rdata = binary.BigEndian.AppendUint16(rdata, option.Code)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(option.Data)))
+		rdata = append(rdata, option.Data...)
+	}
+
+	// the owner is the root, the class field holds the UDP payload size
+	return ResourceRecord{Type: OPT, Class: QClass(o.UDPSize), TTL: ttl, Data: rdata}
+}
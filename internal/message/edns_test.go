@@ -0,0 +1,120 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+// exampleMsg unpacks exampleQuery.
+func exampleMsg(t *testing.T) *Msg {
+	t.Helper()
+
+	var m Msg
+	if err := m.Unpack(exampleQuery); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	return &m
+}
+
+func TestEDNSRoundTrip(t *testing.T) {
+	opt := &EDNS{
+		UDPSize:  4096,
+		ExtRcode: 1,
+		DO:       true,
+		Options:  []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+	}
+
+	query := exampleMsg(t)
+	query.SetEDNS(opt)
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	var m Msg
+	if err := m.Unpack(data); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if len(m.Additional) != 1 {
+		t.Fatalf("ARCOUNT expected 1, got %d", len(m.Additional))
+	}
+
+	parsed, err := m.EDNS()
+	if err != nil {
+		t.Fatalf("EDNS: %v", err)
+	}
+	if parsed == nil {
+		t.Fatal("OPT record not found")
+	}
+
+	if parsed.UDPSize != 4096 || parsed.ExtRcode != 1 || parsed.Version != 0 || !parsed.DO {
+		t.Errorf("unexpected OPT fields: %+v", parsed)
+	}
+	if len(parsed.Options) != 1 || parsed.Options[0].Code != 10 || !bytes.Equal(parsed.Options[0].Data, opt.Options[0].Data) {
+		t.Errorf("unexpected options: %+v", parsed.Options)
+	}
+}
+
+func TestEDNSAbsent(t *testing.T) {
+	opt, err := exampleMsg(t).EDNS()
+	if err != nil {
+		t.Fatalf("EDNS: %v", err)
+	}
+	if opt != nil {
+		t.Errorf("expected no OPT record, got %+v", opt)
+	}
+	if opt.PayloadSize(1232) != MinUDPSize {
+		t.Errorf("client without EDNS must get %d bytes", MinUDPSize)
+	}
+}
+
+func TestEDNSDuplicate(t *testing.T) {
+	query := exampleMsg(t)
+	query.SetEDNS(&EDNS{UDPSize: 1232})
+	query.SetEDNS(&EDNS{UDPSize: 1232})
+
+	if _, err := query.EDNS(); Rcode(err) != RcodeFormatError {
+		t.Errorf("expected FORMERR for two OPT records, got %v", err)
+	}
+}
+
+func TestPayloadSize(t *testing.T) {
+	tests := []struct {
+		advertised uint16
+		limit      int
+		expected   int
+	}{
+		{4096, 1232, 1232},
+		{1000, 1232, 1000},
+		{100, 1232, MinUDPSize},
+		{4096, 0, MinUDPSize},
+	}
+
+	for _, tt := range tests {
+		opt := &EDNS{UDPSize: tt.advertised}
+		if got := opt.PayloadSize(tt.limit); got != tt.expected {
+			t.Errorf("PayloadSize(%d) with advertised %d: expected %d, got %d", tt.limit, tt.advertised, tt.expected, got)
+		}
+	}
+}
+
+func TestSetPayloadSize(t *testing.T) {
+	query := exampleMsg(t)
+	query.SetEDNS(&EDNS{UDPSize: 4096, DO: true})
+
+	if !query.SetPayloadSize(1232) {
+		t.Fatal("OPT record not found")
+	}
+
+	opt, err := query.EDNS()
+	if err != nil {
+		t.Fatalf("EDNS: %v", err)
+	}
+	if opt.UDPSize != 1232 || !opt.DO {
+		t.Errorf("unexpected OPT after rewrite: %+v", opt)
+	}
+
+	if exampleMsg(t).SetPayloadSize(1232) {
+		t.Error("SetPayloadSize reported an OPT record in a plain query")
+	}
+}
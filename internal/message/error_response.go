@@ -0,0 +1,36 @@
+package message
+
+import (
+	"errors"
+)
+
+// Rcode returns the response code that reports err to the client. Errors that
+// don't carry a code of their own are treated as server failures.
+func Rcode(err error) uint8 {
+	switch {
+	case err == nil:
+		return RcodeSuccess
+	case errors.Is(err, ErrFormatError):
+		return RcodeFormatError
+	case errors.Is(err, ErrNameError):
+		return RcodeNameError
+	case errors.Is(err, ErrNotImplemented), errors.Is(err, ErrUnSupported):
+		return RcodeNotImplemented
+	case errors.Is(err, ErrRefused):
+		return RcodeRefused
+	case errors.Is(err, ErrBadVersion):
+		return RcodeBadVersion
+	default:
+		return RcodeServerFailure
+	}
+}
+
+// ErrorReply builds a reply to query that carries rcode. query may be what
+// Unpack decoded before it failed. The reply echoes the query ID, opcode, RD
+// bit and the first question, if there is one. Only the lower four bits of
+// rcode fit the header, extended codes need an OPT record from the caller.
+func ErrorReply(query *Msg, rcode uint8) *Msg {
+	reply := query.Reply(rcode)
+	reply.Question = reply.Question[:min(len(reply.Question), 1)]
+	return reply
+}
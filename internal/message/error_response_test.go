@@ -0,0 +1,86 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var exampleQuery = []byte{
+	0x12, 0x34, // ID
+	0x01, 0x00, // Flags (RD)
+	0x00, 0x01, // QDCOUNT
+	0x00, 0x00, // ANCOUNT
+	0x00, 0x00, // NSCOUNT
+	0x00, 0x00, // ARCOUNT
+
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e',
+	0x03, 'c', 'o', 'm',
+	0x00,
+
+	0x00, 0x01, 0x00, 0x01,
+}
+
+func TestRcode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected uint8
+	}{
+		{nil, RcodeSuccess},
+		{ErrFormatError, RcodeFormatError},
+		{fmt.Errorf("%w: truncated question", ErrFormatError), RcodeFormatError},
+		{ErrNotImplemented, RcodeNotImplemented},
+		{ErrRefused, RcodeRefused},
+		{ErrNameError, RcodeNameError},
+		{errors.New("upstream is down"), RcodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		if got := Rcode(tt.err); got != tt.expected {
+			t.Errorf("Rcode(%v): expected %d, got %d", tt.err, tt.expected, got)
+		}
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	resp := ErrorReply(exampleMsg(t), RcodeRefused)
+
+	if resp.Header.ID != 0x1234 {
+		t.Errorf("ID is not echoed: %04x", resp.Header.ID)
+	}
+
+	QR, OPcode, _, _, RD, RA, _, Rcode := resp.Header.parseFlags()
+	if QR != 1 || OPcode != 0 || RD != 1 || RA != 1 || Rcode != RcodeRefused {
+		t.Errorf("unexpected flags: %016b", resp.Header.Flags)
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if !bytes.Equal(data[12:], exampleQuery[12:]) {
+		t.Errorf("question is not echoed: %v", data[12:])
+	}
+}
+
+func TestErrorReplyMalformed(t *testing.T) {
+	var query Msg
+	if err := query.Unpack(exampleQuery[:20]); err == nil {
+		t.Fatal("truncated query unpacked without an error")
+	}
+
+	resp, err := ErrorReply(&query, RcodeFormatError).Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if len(resp) != 12 {
+		t.Fatalf("expected header-only response, got %d bytes", len(resp))
+	}
+	if resp[0] != 0x12 || resp[1] != 0x34 {
+		t.Errorf("ID is not echoed: %v", resp[0:2])
+	}
+	if resp[3]&0xF != RcodeFormatError {
+		t.Errorf("RCODE expected %d, got %d", RcodeFormatError, resp[3]&0xF)
+	}
+}
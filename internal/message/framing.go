@@ -0,0 +1,47 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxTCPMsgSize is the largest message that fits the two-byte length prefix
+// used by TCP-based transports (RFC 1035 4.2.2).
+const MaxTCPMsgSize = 65535
+
+var ErrEmptyFrame = errors.New("zero-length DNS message")
+
+// ReadFramed reads one length-prefixed DNS message from r.
+func ReadFramed(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(prefix[:])
+	if length == 0 {
+		return nil, ErrEmptyFrame
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// WriteFramed writes msg to w prefixed with its two-byte length.
+func WriteFramed(w io.Writer, msg []byte) error {
+	if len(msg) > MaxTCPMsgSize {
+		return errors.New("DNS message is too long for TCP framing")
+	}
+
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame[:2], uint16(len(msg)))
+	copy(frame[2:], msg)
+
+	_, err := w.Write(frame)
+	return err
+}
@@ -14,6 +14,7 @@ var (
 	ErrNotImplemented = errors.New("the name server doesn't support the requested kind of query")
 	ErrRefused        = errors.New("the name server refuses to perform the specified operation for policy reasons")
 	ErrUnSupported    = errors.New("the unsupported option opcode (reserved for future)")
+	ErrBadVersion     = errors.New("the EDNS version of the query is not supported")
 )
 
 const (
@@ -27,6 +28,16 @@ const (
 	RcodeBit  = 0  //  (Response Code, 4 bits)
 )
 
+const (
+	RcodeSuccess        uint8 = 0  // No error condition
+	RcodeFormatError    uint8 = 1  // Format error
+	RcodeServerFailure  uint8 = 2  // Server failure
+	RcodeNameError      uint8 = 3  // Name Error
+	RcodeNotImplemented uint8 = 4  // Not Implemented
+	RcodeRefused        uint8 = 5  // Refused
+	RcodeBadVersion     uint8 = 16 // Bad OPT Version, needs the EDNS extended RCODE
+)
+
 type Header struct {
 	ID      uint16 // ID of record
 	Flags   uint16 //
@@ -41,12 +52,9 @@ const (
 	ErrQdcountZero = "QDCOUNT is 0"
 )
 
-func HandleHeader(data []byte) (*Header, error) {
-	if len(data) < 12 {
-		return &Header{}, errors.New(ErrShortMsg)
-	}
-
-	h := &Header{
+// decodeHeader reads the fixed 12-byte header at the start of data.
+func decodeHeader(data []byte) Header {
+	return Header{
 		ID:      binary.BigEndian.Uint16(data[0:2]),
 		Flags:   binary.BigEndian.Uint16(data[2:4]),
 		Qdcount: binary.BigEndian.Uint16(data[4:6]),
@@ -54,11 +62,15 @@ func HandleHeader(data []byte) (*Header, error) {
 		Nscount: binary.BigEndian.Uint16(data[8:10]),
 		Arcount: binary.BigEndian.Uint16(data[10:12]),
 	}
+}
 
+// Check returns the error to answer a query with this header, or nil if it
+// is a standard query with at least one question.
+func (h *Header) Check() error {
 	QR, OPcode, AA, TC, RD, RA, Z, Rcode := h.parseFlags()
 
 	if h.Qdcount == 0 {
-		return &Header{}, errors.New(ErrQdcountZero)
+		return errors.New(ErrQdcountZero)
 	}
 
 	if OPcode != 0 {
@@ -69,20 +81,20 @@ func HandleHeader(data []byte) (*Header, error) {
 
 	switch Rcode {
 	case 1:
-		return nil, ErrFormatError
+		return ErrFormatError
 	case 2:
-		return nil, ErrServerFailure
+		return ErrServerFailure
 	case 3:
-		return nil, ErrNameError
+		return ErrNameError
 	case 4:
-		return nil, ErrNotImplemented
+		return ErrNotImplemented
 	case 5:
-		return nil, ErrRefused
+		return ErrRefused
 	case 6, 7, 8, 9, 10, 11, 12, 13, 14, 15:
-		return nil, ErrUnSupported
+		return ErrUnSupported
 	}
 
-	return h, nil
+	return nil
 }
 
 func (h *Header) parseFlags() (QR, OPcode, AA, TC, RD, RA, Z, Rcode uint8) {
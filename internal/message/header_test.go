@@ -2,6 +2,8 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -52,9 +54,9 @@ func TestHeaderRoundTrip(t *testing.T) {
 
 	encoded, _ := original.Decode()
 
-	decoded, err := HandleHeader(encoded)
-	if err != nil {
-		t.Fatalf("HandleHeader failed: %v", err)
+	decoded := decodeHeader(encoded)
+	if err := decoded.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
 	}
 
 	if original.ID != decoded.ID {
@@ -98,9 +100,9 @@ func TestParseFlagsFromRealDNS(t *testing.T) {
 		0x00, 0x01, // ARCOUNT = 1
 	}
 
-	h, err := HandleHeader(dnsPacket)
-	if err != nil {
-		t.Fatalf("HandleHeader failed: %v", err)
+	h := decodeHeader(dnsPacket)
+	if err := h.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
 	}
 
 	if h.ID != 0x1234 {
@@ -128,15 +130,19 @@ func TestParseFlagsFromRealDNS(t *testing.T) {
 
 func TestErrorConditions(t *testing.T) {
 	shortData := []byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x03} // 6 bytes
-	if _, err := HandleHeader(shortData); err == nil {
+	var m Msg
+	if err := m.Unpack(shortData); err == nil {
 		t.Error("Expected error for short header, got nil")
-	} else if err.Error() != ErrShortMsg {
+	} else if !errors.Is(err, ErrFormatError) || !strings.Contains(err.Error(), ErrShortMsg) {
 		t.Errorf("Expected '%s', got: %v", ErrShortMsg, err)
 	}
 
 	zeroQdcount := make([]byte, 12)
 	binary.BigEndian.PutUint16(zeroQdcount[4:6], 0) // QDCOUNT = 0
-	if _, err := HandleHeader(zeroQdcount); err == nil {
+	if err := m.Unpack(zeroQdcount); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if err := m.Header.Check(); err == nil {
 		t.Error("Expected error for QDCOUNT=0, got nil")
 	} else if err.Error() != ErrQdcountZero {
 		t.Errorf("Expected '%s', got: %v", ErrQdcountZero, err)
@@ -0,0 +1,246 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/Vladroon22/DNS-Server/internal/compress"
+)
+
+// maxPointer is the largest offset a compression pointer can hold.
+const maxPointer = 0x3FFF
+
+// Msg is a whole DNS message. Unpack fills it from the wire and Pack writes it
+// back; the section counts of Header follow the length of the slices, so
+// records can be added or removed freely in between.
+type Msg struct {
+	Header     Header
+	Question   []Question
+	Answer     []ResourceRecord
+	Authority  []ResourceRecord
+	Additional []ResourceRecord
+}
+
+// Unpack decodes data into m. Names inside the RDATA of the well-known types
+// are decompressed and every RDATA is copied, so m doesn't refer to data once
+// it returns. When data is malformed past its header m keeps what was decoded
+// before the error, which is enough to build an error reply.
+func (m *Msg) Unpack(data []byte) error {
+	*m = Msg{}
+	if len(data) < 12 {
+		return fmt.Errorf("%w: %s", ErrFormatError, ErrShortMsg)
+	}
+
+	m.Header = decodeHeader(data)
+
+	offset := 12
+	for range m.Header.Qdcount {
+		name, next, err := readName(data, offset, data)
+		if err != nil {
+			return err
+		}
+		if next+4 > len(data) {
+			return fmt.Errorf("%w: truncated question", ErrFormatError)
+		}
+		m.Question = append(m.Question, Question{
+			Name:  name,
+			Type:  QType(binary.BigEndian.Uint16(data[next : next+2])),
+			Class: QClass(binary.BigEndian.Uint16(data[next+2 : next+4])),
+		})
+		offset = next + 4
+	}
+
+	sections := []*[]ResourceRecord{&m.Answer, &m.Authority, &m.Additional}
+	for i, count := range []uint16{m.Header.Ancount, m.Header.Nscount, m.Header.Arcount} {
+		for range count {
+			var (
+				rr  ResourceRecord
+				err error
+			)
+			if rr, offset, err = readRecord(data, offset); err != nil {
+				return err
+			}
+			if rr.Data, err = expandRDATA(data, offset-len(rr.Data), rr); err != nil {
+				return err
+			}
+			rr.Data = append([]byte(nil), rr.Data...)
+			*sections[i] = append(*sections[i], rr)
+		}
+	}
+
+	return nil
+}
+
+// Pack returns the wire form of m. Question and owner names are compressed,
+// RDATA is written as it is.
+func (m *Msg) Pack() ([]byte, error) {
+	msg, _, err := m.pack()
+	return msg, err
+}
+
+// pack is Pack that also returns the offset where the question section ends,
+// followed by the offset after every record.
+func (m *Msg) pack() ([]byte, []int, error) {
+	header := m.Header
+	for _, c := range []struct {
+		count *uint16
+		n     int
+	}{
+		{&header.Qdcount, len(m.Question)},
+		{&header.Ancount, len(m.Answer)},
+		{&header.Nscount, len(m.Authority)},
+		{&header.Arcount, len(m.Additional)},
+	} {
+		if c.n > 0xFFFF {
+			return nil, nil, fmt.Errorf("%w: %d entries in a section", ErrFormatError, c.n)
+		}
+		*c.count = uint16(c.n)
+	}
+
+	msg, err := header.Decode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmp := compress.NewCompress()
+	for _, que := range m.Question {
+		if msg, err = packName(msg, que.Name, cmp); err != nil {
+			return nil, nil, err
+		}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(que.Type))
+		msg = binary.BigEndian.AppendUint16(msg, uint16(que.Class))
+	}
+	ends := []int{len(msg)}
+
+	for _, section := range [][]ResourceRecord{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if len(rr.Data) > 0xFFFF {
+				return nil, nil, fmt.Errorf("%w: RDATA of %s type %d too long", ErrFormatError, rr.Name, rr.Type)
+			}
+			if msg, err = packName(msg, rr.Name, cmp); err != nil {
+				return nil, nil, err
+			}
+			msg = binary.BigEndian.AppendUint16(msg, uint16(rr.Type))
+			msg = binary.BigEndian.AppendUint16(msg, uint16(rr.Class))
+			msg = binary.BigEndian.AppendUint32(msg, rr.TTL)
+			msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.Data)))
+			msg = append(msg, rr.Data...)
+			ends = append(ends, len(msg))
+		}
+	}
+
+	if len(msg) > MaxTCPMsgSize {
+		return nil, nil, fmt.Errorf("%w: message of %d bytes", ErrFormatError, len(msg))
+	}
+	return msg, ends, nil
+}
+
+// packName appends name to msg, as a pointer when the same name was written
+// before. Names past maxPointer can't be pointed to and are written in full.
+func packName(msg []byte, name string, cmp *compress.Compress) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("%w: name %q too long", ErrFormatError, name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("%w: bad label in %q", ErrFormatError, name)
+			}
+		}
+	}
+
+	if len(msg) > maxPointer {
+		return appendName(msg, name), nil
+	}
+	return append(msg, cmp.EncodeName(name, len(msg))...), nil
+}
+
+// Rcode returns the response code in the header of m, without the extended
+// bits of the OPT record.
+func (m *Msg) Rcode() uint8 {
+	return uint8(m.Header.Flags & 0xF)
+}
+
+// SetRcode puts the lower four bits of rcode into the header of m.
+func (m *Msg) SetRcode(rcode uint8) {
+	m.Header.Flags = m.Header.Flags&^0xF | uint16(rcode&0xF)
+}
+
+// Reply returns an empty response to m carrying rcode. It keeps the ID,
+// opcode, RD bit and questions of m and sets RA.
+func (m *Msg) Reply(rcode uint8) *Msg {
+	_, opcode, _, _, rd, _, _, _ := m.Header.parseFlags()
+
+	reply := &Msg{
+		Header:   Header{ID: m.Header.ID},
+		Question: append([]Question(nil), m.Question...),
+	}
+	reply.Header.SetFlags(1, opcode, 0, 0, rd, 1, 0, rcode)
+	return reply
+}
+
+// EDNS returns the OPT record of m, or nil if there isn't one.
+func (m *Msg) EDNS() (*EDNS, error) {
+	var opt *ResourceRecord
+	for i, rr := range m.Additional {
+		if rr.Type != OPT {
+			continue
+		}
+		if opt != nil {
+			return nil, fmt.Errorf("%w: more than one OPT record", ErrFormatError)
+		}
+		opt = &m.Additional[i]
+	}
+	if opt == nil {
+		return nil, nil
+	}
+	return parseOPT(*opt)
+}
+
+// Copy returns a copy of m whose sections can be changed without touching m.
+// RDATA is shared, it is never changed in place.
+func (m *Msg) Copy() *Msg {
+	return &Msg{
+		Header:     m.Header,
+		Question:   append([]Question(nil), m.Question...),
+		Answer:     append([]ResourceRecord(nil), m.Answer...),
+		Authority:  append([]ResourceRecord(nil), m.Authority...),
+		Additional: append([]ResourceRecord(nil), m.Additional...),
+	}
+}
+
+// MinAnswerTTL returns the smallest TTL in the answer section of m. It
+// reports false when there are no answers.
+func (m *Msg) MinAnswerTTL() (uint32, bool) {
+	if len(m.Answer) == 0 {
+		return 0, false
+	}
+
+	ttl := ^uint32(0)
+	for _, rr := range m.Answer {
+		ttl = min(ttl, rr.TTL)
+	}
+	return ttl, true
+}
+
+// SetEDNS adds opt to the additional section of m. A nil opt is ignored.
+func (m *Msg) SetEDNS(opt *EDNS) {
+	if opt != nil {
+		m.Additional = append(m.Additional, opt.Record())
+	}
+}
+
+// SetPayloadSize rewrites the UDP payload size advertised by the OPT record
+// of m. It reports whether m has an OPT record.
+func (m *Msg) SetPayloadSize(size uint16) bool {
+	for i := range m.Additional {
+		if m.Additional[i].Type == OPT {
+			// the class of an OPT record holds the payload size
+			m.Additional[i].Class = QClass(size)
+			return true
+		}
+	}
+	return false
+}
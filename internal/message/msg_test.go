@@ -0,0 +1,159 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fullMsg() *Msg {
+	soa := appendName(nil, "ns1.example.com")
+	soa = appendName(soa, "hostmaster.example.com")
+	soa = append(soa, make([]byte, 20)...)
+
+	m := &Msg{
+		Header:   Header{ID: 0x1234},
+		Question: []Question{{Name: "WWW.example.com", Type: A, Class: IN}},
+		Answer: []ResourceRecord{
+			{Name: "WWW.example.com", Type: CNAME, Class: IN, TTL: 300, Data: appendName(nil, "cdn.example.net")},
+			{Name: "cdn.example.net", Type: A, Class: IN, TTL: 60, Data: []byte{10, 0, 0, 1}},
+			{Name: "cdn.example.net", Type: A, Class: IN, TTL: 60, Data: []byte{10, 0, 0, 2}},
+		},
+		Authority: []ResourceRecord{
+			{Name: "example.com", Type: SOA, Class: IN, TTL: 3600, Data: soa},
+			{Name: "example.com", Type: MX, Class: IN, TTL: 3600, Data: appendName([]byte{0, 10}, "mail.example.com")},
+		},
+		Additional: []ResourceRecord{
+			// неизвестный тип передаётся как есть (RFC 3597)
+			{Name: "example.com", Type: 65280, Class: IN, TTL: 10, Data: []byte{1, 2, 3}},
+		},
+	}
+	m.Header.SetFlags(1, 0, 1, 0, 1, 1, 0, RcodeSuccess)
+	m.SetEDNS(&EDNS{UDPSize: 1232, DO: true, Options: []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}})
+	return m
+}
+
+func TestMsgRoundTrip(t *testing.T) {
+	want := fullMsg()
+	data, err := want.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	var got Msg
+	if err := got.Unpack(data); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	// Pack выставляет счётчики секций сам
+	want.Header.Qdcount, want.Header.Ancount, want.Header.Nscount, want.Header.Arcount = 1, 3, 2, 2
+	if !reflect.DeepEqual(&got, want) {
+		t.Fatalf("round trip changed the message:\n got %+v\nwant %+v", got, *want)
+	}
+
+	again, err := got.Pack()
+	if err != nil {
+		t.Fatalf("second Pack: %v", err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Error("packing an unpacked message gives different bytes")
+	}
+
+	opt, err := got.EDNS()
+	if err != nil || opt == nil || opt.UDPSize != 1232 || !opt.DO || len(opt.Options) != 1 {
+		t.Errorf("OPT record lost: %+v, %v", opt, err)
+	}
+}
+
+func TestPackCompressesNames(t *testing.T) {
+	m := fullMsg()
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	// владельцы записей повторяют имя вопроса и ссылаются на него
+	if bytes.Count(data, []byte("\x03cdn\x07example\x03net\x00")) != 2 {
+		t.Error("cdn.example.net must be written once as owner and once in the CNAME RDATA")
+	}
+	if !bytes.Contains(data, []byte{0xC0, 12}) {
+		t.Error("owner of the CNAME doesn't point to the question")
+	}
+}
+
+func TestUnpackExpandsRDATA(t *testing.T) {
+	// CNAME www.example.com → cdn.example.com, имя в RDATA сжато указателем на вопрос
+	msg := []byte{0, 1, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}
+	msg = appendName(msg, "www.example.com")
+	msg = append(msg, 0, 5, 0, 1)
+	msg = append(msg, 0xC0, 12, 0, 5, 0, 1, 0, 0, 0, 60, 0, 6, 3, 'c', 'd', 'n', 0xC0, 16)
+
+	var m Msg
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].Name != "www.example.com" {
+		t.Fatalf("unexpected answer %+v", m.Answer)
+	}
+	if target, err := m.Answer[0].Target(); err != nil || target != "cdn.example.com" {
+		t.Errorf("expected cdn.example.com, got %q (%v)", target, err)
+	}
+
+	msg[len(msg)-1] = 0xFF
+	if m.Answer[0].Data[0] != 3 || bytes.Contains(m.Answer[0].Data, []byte{0xFF}) {
+		t.Error("RDATA still refers to the input buffer")
+	}
+}
+
+func TestUnpackRejectsTruncated(t *testing.T) {
+	data, err := fullMsg().Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	for _, n := range []int{0, 11, 20, len(data) - 1} {
+		var m Msg
+		if err := m.Unpack(data[:n]); err == nil {
+			t.Errorf("%d of %d bytes unpacked without an error", n, len(data))
+		}
+	}
+}
+
+func TestPackRejectsBadNames(t *testing.T) {
+	for _, name := range []string{strings.Repeat("a", 64) + ".com", "www..example.com", strings.Repeat("abcdefg.", 40)} {
+		m := &Msg{Question: []Question{{Name: name, Type: A, Class: IN}}}
+		if _, err := m.Pack(); !errors.Is(err, ErrFormatError) {
+			t.Errorf("name %q packed without an error", name)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	var query Msg
+	if err := query.Unpack(exampleQuery); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	reply := query.Reply(RcodeNameError)
+	QR, OPcode, _, _, RD, RA, _, _ := reply.Header.parseFlags()
+	if reply.Header.ID != query.Header.ID || QR != 1 || RA != 1 || OPcode != 0 {
+		t.Errorf("unexpected reply header %+v", reply.Header)
+	}
+	if wantRD := uint8((query.Header.Flags >> RDBit) & 1); RD != wantRD {
+		t.Errorf("RD expected %d, got %d", wantRD, RD)
+	}
+	if reply.Rcode() != RcodeNameError || !reflect.DeepEqual(reply.Question, query.Question) {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	data, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if binary.BigEndian.Uint16(data[4:6]) != 1 || binary.BigEndian.Uint16(data[6:8]) != 0 {
+		t.Error("section counts don't follow the sections")
+	}
+}
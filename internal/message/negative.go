@@ -0,0 +1,79 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Negative is an answer saying that a name doesn't exist (NXDOMAIN) or has no
+// records of the asked type (NODATA), as described in RFC 2308.
+type Negative struct {
+	// Name is where the denial applies: the question name or the end of the
+	// CNAME chain leading from it.
+	Name  string
+	Type  QType
+	Class QClass
+	Rcode uint8
+	SOA   ResourceRecord
+	// TTL is the smaller of the SOA TTL and its MINIMUM field.
+	TTL uint32
+}
+
+// ParseNegative returns the denial carried by resp, or nil when resp answers
+// the question or doesn't prove the answer is empty with an SOA of a zone the
+// name belongs to.
+func ParseNegative(resp *Msg) (*Negative, error) {
+	if len(resp.Question) != 1 {
+		return nil, fmt.Errorf("%w: expected one question, got %d", ErrFormatError, len(resp.Question))
+	}
+
+	var err error
+	rcode := resp.Rcode()
+	if rcode != RcodeSuccess && rcode != RcodeNameError {
+		return nil, nil
+	}
+
+	que := resp.Question[0]
+	name := que.Name
+	for range len(resp.Answer) + 1 {
+		next := ""
+		for _, rr := range resp.Answer {
+			if !EqualNames(rr.Name, name) || rr.Class != que.Class {
+				continue
+			}
+			if rr.Type == que.Type {
+				return nil, nil
+			}
+			if rr.Type == CNAME && que.Type != CNAME {
+				if next, err = rr.Target(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	for _, rr := range resp.Authority {
+		if rr.Type != SOA || rr.Class != que.Class || !InBailiwick(name, rr.Name) {
+			continue
+		}
+		if len(rr.Data) < 20 {
+			return nil, fmt.Errorf("%w: SOA RDATA too short", ErrFormatError)
+		}
+
+		return &Negative{
+			Name:  strings.TrimSuffix(name, "."),
+			Type:  que.Type,
+			Class: que.Class,
+			Rcode: rcode,
+			SOA:   rr,
+			TTL:   min(rr.TTL, binary.BigEndian.Uint32(rr.Data[len(rr.Data)-4:])),
+		}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,65 @@
+package message
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// negativeResponse answers name/qtype with rcode, the records in an and the
+// SOA of example.com in the authority section.
+func negativeResponse(name string, qtype QType, rcode uint8, soaTTL, minimum uint32, an ...ResourceRecord) *Msg {
+	soa := appendName(appendName(nil, "ns1.example.com"), "admin.example.com")
+	soa = append(soa, make([]byte, 16)...)
+	soa = binary.BigEndian.AppendUint32(soa, minimum)
+
+	m := &Msg{
+		Header:    Header{ID: 0xABCD, Flags: 0x8180},
+		Question:  []Question{{Name: name, Type: qtype, Class: IN}},
+		Answer:    an,
+		Authority: []ResourceRecord{{Name: "example.com", Type: SOA, Class: IN, TTL: soaTTL, Data: soa}},
+	}
+	m.SetRcode(rcode)
+	return m
+}
+
+func TestParseNegative(t *testing.T) {
+	cname := ResourceRecord{Name: "www.example.com", Type: CNAME, Class: IN, TTL: 300, Data: appendName(nil, "gone.example.com")}
+
+	tests := []struct {
+		name     string
+		resp     *Msg
+		want     bool
+		wantName string
+		rcode    uint8
+		ttl      uint32
+	}{
+		{"nxdomain", negativeResponse("missing.example.com", A, RcodeNameError, 3600, 900), true, "missing.example.com", RcodeNameError, 900},
+		{"nodata", negativeResponse("example.com", AAAA, RcodeSuccess, 60, 900), true, "example.com", RcodeSuccess, 60},
+		// отрицательный ответ относится к концу цепочки CNAME
+		{"after cname", negativeResponse("www.example.com", A, RcodeNameError, 3600, 900, cname), true, "gone.example.com", RcodeNameError, 900},
+		{"soa of another zone", negativeResponse("missing.example.org", A, RcodeNameError, 3600, 900), false, "", 0, 0},
+		{"server failure", negativeResponse("missing.example.com", A, RcodeServerFailure, 3600, 900), false, "", 0, 0},
+		{"positive", negativeResponse("www.example.com", CNAME, RcodeSuccess, 3600, 900, cname), false, "", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			neg, err := ParseNegative(tt.resp)
+			if err != nil {
+				t.Fatalf("ParseNegative: %v", err)
+			}
+			if (neg != nil) != tt.want {
+				t.Fatalf("expected negative %v, got %+v", tt.want, neg)
+			}
+			if neg == nil {
+				return
+			}
+			if neg.Name != tt.wantName || neg.Rcode != tt.rcode || neg.TTL != tt.ttl {
+				t.Errorf("got %s rcode %d ttl %d, expected %s rcode %d ttl %d", neg.Name, neg.Rcode, neg.TTL, tt.wantName, tt.rcode, tt.ttl)
+			}
+			if neg.SOA.Type != SOA || neg.SOA.Name != "example.com" {
+				t.Errorf("wrong SOA %+v", neg.SOA)
+			}
+		})
+	}
+}
@@ -3,34 +3,32 @@ package message
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
 	"strings"
-	"sync"
-
-	"github.com/Vladroon22/DNS-Server/internal/cache"
 )
 
 type QType uint16
 
 const (
-	_     QType      = iota
-	A                // a host address
-	NS               // an authoritative name server
-	MD               // a mail destination
-	MF               // a mail forwarder
-	CNAME            // the canonical name for an alias
-	SOA              // marks the start of a zone of authority
-	MB               // a mailbox domain name (EXPERIMENTAL)
-	MG               // a mail group member (EXPERIMENTAL)
-	MR               // a mail rename domain name (EXPERIMENTAL)
-	NULL             // a null RR (EXPERIMENTAL)
-	WKS              // a well known service description
-	PTR              // a domain name pointer
-	HINFO            // host information
-	MINFO            // mailbox or mail list information
-	MX               // mail exchange
-	TXT              // text strings
-	AAAA  = TXT + 12 // ipv6 address
+	_     QType       = iota
+	A                 // a host address
+	NS                // an authoritative name server
+	MD                // a mail destination
+	MF                // a mail forwarder
+	CNAME             // the canonical name for an alias
+	SOA               // marks the start of a zone of authority
+	MB                // a mailbox domain name (EXPERIMENTAL)
+	MG                // a mail group member (EXPERIMENTAL)
+	MR                // a mail rename domain name (EXPERIMENTAL)
+	NULL              // a null RR (EXPERIMENTAL)
+	WKS               // a well known service description
+	PTR               // a domain name pointer
+	HINFO             // host information
+	MINFO             // mailbox or mail list information
+	MX                // mail exchange
+	TXT               // text strings
+	AAAA  = TXT + 12  // ipv6 address
+	SRV   = AAAA + 5  // server selection (RFC 2782)
+	OPT   = AAAA + 13 // EDNS(0) pseudo-record (RFC 6891)
 )
 
 type QClass uint16
@@ -51,7 +49,7 @@ type Question struct {
 
 func readName(data []byte, offset int, origData []byte) (string, int, error) {
 	names := []string{}
-	visit := make(map[int]bool)
+	start := offset
 
 	for offset < len(data) {
 		length := int(data[offset])
@@ -64,11 +62,11 @@ func readName(data []byte, offset int, origData []byte) (string, int, error) {
 				return "", offset, fmt.Errorf("invalid compression pointer")
 			}
 			ptr := int(binary.BigEndian.Uint16(data[offset:offset+2]) & 0x3FFF)
-			if visit[ptr] {
+			// pointing only before the start of the name rules out loops
+			if ptr >= start {
 				return "", offset, fmt.Errorf("compression is cycled")
 			}
-			visit[ptr] = true
-			name, _, err := readName(data[ptr:], 0, origData)
+			name, _, err := readName(origData, ptr, origData)
 			if err != nil {
 				return "", offset, err
 			}
@@ -84,49 +82,10 @@ func readName(data []byte, offset int, origData []byte) (string, int, error) {
 	return "", offset, fmt.Errorf("unexpected EOF")
 }
 
-func HandleQuestions(data []byte, qdcount uint16, che *cache.Cache) ([]Question, int, error) {
-	questions := make([]Question, 0, qdcount)
-	offset := 12
-
-	for range qdcount {
-		var name string
-		var err error
-		name, offset, err = readName(data, offset, data)
-		if err != nil {
-			return nil, 0, err
-		}
-
-		qtype := binary.BigEndian.Uint16(data[offset : offset+2])
-		qclass := binary.BigEndian.Uint16(data[offset+2 : offset+4])
-		questions = append(questions, Question{Name: name, Type: QType(qtype), Class: QClass(qclass)})
-		offset += 4
-	}
-
-	wg := sync.WaitGroup{}
-	n := len(questions)
-	log.Println("len ques:", n)
-	questionsCh := make(chan Question, n)
-
-	for _, que := range questions {
-		log.Println(que)
-		wg.Add(1)
-		go func(que *Question) {
-			if _, ok := che.Get(uint16(que.Type), que.Name); ok {
-				questionsCh <- *que
-			}
-			wg.Done()
-		}(&que)
-	}
-
-	go func() {
-		wg.Wait()
-		close(questionsCh)
-	}()
-
-	questions = questions[:0]
-	for que := range questionsCh {
-		questions = append(questions, que)
-	}
-
-	return questions, len(questions), nil
+// BuildQuery returns a query for que with recursion desired. Its ID is left
+// zero, the receiver sets a random one before sending it.
+func BuildQuery(que Question) ([]byte, error) {
+	query := &Msg{Question: []Question{que}}
+	query.Header.SetFlags(0, 0, 0, 0, 1, 0, 0, 0)
+	return query.Pack()
 }
@@ -0,0 +1,43 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type ResourceRecord struct {
+	Name  string
+	Type  QType
+	Class QClass
+	TTL   uint32
+	Data  []byte
+}
+
+// readRecord decodes the resource record that starts at offset. Data is a
+// slice of msg, not a copy.
+func readRecord(msg []byte, offset int) (ResourceRecord, int, error) {
+	name, offset, err := readName(msg, offset, msg)
+	if err != nil {
+		return ResourceRecord{}, offset, err
+	}
+
+	if offset+10 > len(msg) {
+		return ResourceRecord{}, offset, fmt.Errorf("%w: truncated resource record", ErrFormatError)
+	}
+
+	rr := ResourceRecord{
+		Name:  name,
+		Type:  QType(binary.BigEndian.Uint16(msg[offset : offset+2])),
+		Class: QClass(binary.BigEndian.Uint16(msg[offset+2 : offset+4])),
+		TTL:   binary.BigEndian.Uint32(msg[offset+4 : offset+8]),
+	}
+	length := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+	offset += 10
+
+	if offset+length > len(msg) {
+		return ResourceRecord{}, offset, fmt.Errorf("%w: RDATA exceeds message", ErrFormatError)
+	}
+	rr.Data = msg[offset : offset+length]
+
+	return rr, offset + length, nil
+}
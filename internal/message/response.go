@@ -1,85 +1,109 @@
 package message
 
 import (
-	"bytes"
-	"encoding/binary"
-	"log"
-	"sync"
-
 	"github.com/Vladroon22/DNS-Server/internal/cache"
-	"github.com/Vladroon22/DNS-Server/internal/compress"
 )
 
-type ResponseBuilder struct {
-	buffer *bytes.Buffer
-	cmp    *compress.Compress
-	mtx    sync.RWMutex
-}
-
-func NewResponseBuilder() *ResponseBuilder {
-	return &ResponseBuilder{
-		cmp:    compress.NewCompress(),
-		buffer: bytes.NewBuffer(nil),
+// maxChain bounds the CNAMEs followed through the cache.
+const maxChain = 8
+
+// StaleTTL is the TTL of expired records served when the upstreams fail, so
+// clients come back soon for a fresh answer (RFC 8767).
+const StaleTTL = 30
+
+// lookupChain returns the cached RRsets answering que: the CNAMEs leading on
+// from its name, if there are any, and then the RRset of the requested type.
+// The last RRset may be a negative entry saying there is nothing to find.
+// It reports false unless the whole chain is cached. With stale set expired
+// RRsets still in their stale window count as cached.
+func lookupChain(che *cache.Cache, que Question, stale bool) ([]cache.RRset, bool) {
+	get := che.Get
+	if stale {
+		get = che.GetStale
 	}
-}
-
-type Response struct {
-	Data []byte
-	Err  error
-}
 
-func (rb *ResponseBuilder) BuildResponse(header *Header, que Question, che *cache.Cache) Response {
-	header.Ancount++
-
-	decodedHeader, err := header.Decode()
-	if err != nil {
-		return Response{}
-	}
-
-	if _, err := rb.buffer.Write(decodedHeader); err != nil {
-		return Response{}
+	var chain []cache.RRset
+	name := que.Name
+
+	for range maxChain + 1 {
+		if rrset, ok := get(cache.NewKey(name, uint16(que.Type), uint16(que.Class))); ok {
+			return append(chain, rrset), true
+		}
+		if rrset, ok := get(cache.NXDomainKey(name, uint16(que.Class))); ok {
+			return append(chain, rrset), true
+		}
+		if que.Type == CNAME {
+			return nil, false
+		}
+
+		cname, ok := get(cache.NewKey(name, uint16(CNAME), uint16(que.Class)))
+		if !ok || len(cname.Records) == 0 {
+			return nil, false
+		}
+		target, _, err := readName(cname.Records[0], 0, cname.Records[0])
+		if err != nil {
+			return nil, false
+		}
+
+		chain = append(chain, cname)
+		name = target
 	}
 
-	rb.cmp.AddName("", 12)
-	log.Println("DNS response header:", header)
-
-	rb.buffer.Write(rb.cmp.EncodeName(que.Name, rb.buffer.Len()))
-	if err := binary.Write(rb.buffer, binary.BigEndian, que.Type); err != nil {
-		return Response{}
-	}
-
-	if err := binary.Write(rb.buffer, binary.BigEndian, que.Class); err != nil {
-		return Response{}
-	}
-
-	log.Println("DNS response question:", que)
-
-	record, _ := che.Get(uint16(que.Type), que.Name)
-	rb.buffer.Write([]byte{0xC0, 0x0C})
+	return nil, false
+}
 
-	if err := binary.Write(rb.buffer, binary.BigEndian, que.Type); err != nil {
-		return Response{}
+// AnswerFromCache builds the reply to query from che, replaying the CNAME
+// chain that leads to each requested RRset. A cached denial is answered with
+// its RCODE and the SOA of the zone in the authority section. It reports false
+// unless every question is cached. With stale set expired RRsets still in
+// their stale window are used too, all of them answered with StaleTTL.
+func AnswerFromCache(query *Msg, che *cache.Cache, stale bool) (*Msg, bool) {
+	if len(query.Question) == 0 {
+		return nil, false
 	}
 
-	if err := binary.Write(rb.buffer, binary.BigEndian, que.Class); err != nil {
-		return Response{}
+	reply := query.Reply(RcodeSuccess)
+	for _, que := range query.Question {
+		chain, ok := lookupChain(che, que, stale)
+		if !ok {
+			return nil, false
+		}
+
+		for i, rrset := range chain {
+			// the first owner is spelled the way the client asked
+			owner := rrset.Name
+			if i == 0 {
+				owner = que.Name
+			}
+			for _, rdata := range rrset.Records {
+				reply.Answer = append(reply.Answer, ResourceRecord{
+					Name:  owner,
+					Type:  QType(rrset.Type),
+					Class: QClass(rrset.Class),
+					TTL:   answerTTL(rrset, stale),
+					Data:  rdata,
+				})
+			}
+		}
+
+		if last := chain[len(chain)-1]; last.Negative() {
+			reply.SetRcode(last.Rcode)
+			reply.Authority = append(reply.Authority, ResourceRecord{
+				Name:  last.SOAName,
+				Type:  SOA,
+				Class: QClass(last.Class),
+				TTL:   answerTTL(last, stale),
+				Data:  last.SOA,
+			})
+		}
 	}
 
-	ttl := make([]byte, 4)
-	binary.BigEndian.PutUint32(ttl, uint32(record.Exp.Second()))
-	if err := binary.Write(rb.buffer, binary.BigEndian, ttl); err != nil {
-		return Response{}
-	}
+	return reply, true
+}
 
-	if err := binary.Write(rb.buffer, binary.BigEndian, record.Length); err != nil {
-		return Response{}
-	}
-	if _, err := rb.buffer.Write(record.IP); err != nil {
-		return Response{}
+func answerTTL(rrset cache.RRset, stale bool) uint32 {
+	if stale {
+		return StaleTTL
 	}
-
-	total := rb.buffer.Bytes()
-	rb.buffer.Reset()
-
-	return Response{Data: total, Err: nil}
+	return rrset.TTL()
 }
@@ -0,0 +1,68 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expandRDATA returns the RDATA of rr, which starts at offset in msg, with
+// compressed names written out in full.
+func expandRDATA(msg []byte, offset int, rr ResourceRecord) ([]byte, error) {
+	prefix, names := rdataNames(rr.Type)
+	if names == 0 {
+		return rr.Data, nil
+	}
+
+	end := offset + len(rr.Data)
+	if offset+prefix > end {
+		return nil, fmt.Errorf("%w: RDATA too short for type %d", ErrFormatError, rr.Type)
+	}
+
+	out := append([]byte(nil), msg[offset:offset+prefix]...)
+	offset += prefix
+	for range names {
+		name, next, err := readName(msg[:end], offset, msg)
+		if err != nil {
+			return nil, err
+		}
+		out = appendName(out, name)
+		offset = next
+	}
+
+	return append(out, msg[offset:end]...), nil
+}
+
+// rdataNames returns how many domain names the RDATA of type t holds and how
+// many bytes come before the first one.
+func rdataNames(t QType) (prefix, names int) {
+	switch t {
+	case NS, MD, MF, CNAME, MB, MG, MR, PTR:
+		return 0, 1
+	case MX:
+		return 2, 1
+	case SRV:
+		return 6, 1
+	case SOA, MINFO:
+		return 0, 2
+	}
+	return 0, 0
+}
+
+// Target returns the domain name held in the RDATA of a CNAME, NS or PTR
+// record.
+func (rr ResourceRecord) Target() (string, error) {
+	switch rr.Type {
+	case NS, CNAME, PTR:
+	default:
+		return "", fmt.Errorf("type %d has no target name", rr.Type)
+	}
+
+	name, _, err := readName(rr.Data, 0, rr.Data)
+	return name, err
+}
+
+// EqualNames compares domain names the way DNS does, ignoring case and the
+// trailing dot.
+func EqualNames(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
@@ -0,0 +1,65 @@
+package message
+
+// Truncated reports whether the TC bit is set in m.
+func (m *Msg) Truncated() bool {
+	return (m.Header.Flags>>TCBit)&1 == 1
+}
+
+// Truncate packs m, dropping records from the tail so that it fits into limit
+// bytes. The OPT record, if any, is always kept. TC is set when records from
+// the answer or authority sections had to be dropped; losing only additional
+// records doesn't need it (RFC 2181 9). m itself is left as it is.
+func (m *Msg) Truncate(limit int) ([]byte, error) {
+	// the OPT record goes last, so cutting the tail never takes it
+	var opt []ResourceRecord
+	out := *m
+	out.Additional = nil
+	for _, rr := range m.Additional {
+		if rr.Type == OPT {
+			opt = append(opt, rr)
+			continue
+		}
+		out.Additional = append(out.Additional, rr)
+	}
+	out.Additional = append(out.Additional, opt...)
+
+	msg, ends, err := out.pack()
+	if err != nil || len(msg) <= limit {
+		return msg, err
+	}
+
+	// records are only ever dropped from the tail and names only point
+	// backwards, so packing the kept ones gives the same offsets
+	budget := limit
+	records := len(ends) - 1 - len(opt)
+	if len(opt) > 0 {
+		budget -= len(msg) - ends[records]
+	}
+
+	kept := 0
+	for kept < records && ends[kept+1] <= budget {
+		kept++
+	}
+
+	an := min(kept, len(out.Answer))
+	ns := min(kept-an, len(out.Authority))
+	ar := kept - an - ns
+
+	cut := Msg{
+		Header:     out.Header,
+		Question:   out.Question,
+		Answer:     out.Answer[:an],
+		Authority:  out.Authority[:ns],
+		Additional: append(out.Additional[:ar:ar], opt...),
+	}
+	if ends[0] > budget {
+		// not even the question fits, send the bare header
+		cut.Question = nil
+	}
+	if an < len(out.Answer) || ns < len(out.Authority) || cut.Question == nil {
+		QR, OPcode, AA, _, RD, RA, Z, Rcode := cut.Header.parseFlags()
+		cut.Header.SetFlags(QR, OPcode, AA, 1, RD, RA, Z, Rcode)
+	}
+
+	return cut.Pack()
+}
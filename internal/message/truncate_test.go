@@ -0,0 +1,98 @@
+package message
+
+import (
+	"testing"
+)
+
+// buildAnswer returns a reply to exampleQuery with n A records and extra
+// additional records.
+func buildAnswer(n, extra int) *Msg {
+	var resp Msg
+	resp.Unpack(exampleQuery)
+	resp.Header.Flags = 0x8180
+
+	for i := range n + extra {
+		rr := ResourceRecord{Name: "example.com", Type: A, Class: IN, TTL: 300, Data: []byte{10, 0, 0, byte(i)}}
+		if i < n {
+			resp.Answer = append(resp.Answer, rr)
+		} else {
+			resp.Additional = append(resp.Additional, rr)
+		}
+	}
+	return &resp
+}
+
+func TestTruncateFits(t *testing.T) {
+	resp := buildAnswer(3, 0)
+	full, _ := resp.Pack()
+
+	out, err := resp.Truncate(MinUDPSize)
+	if err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	var m Msg
+	if err := m.Unpack(out); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if len(out) != len(full) || m.Truncated() {
+		t.Error("message that fits must not be changed")
+	}
+}
+
+func TestTruncateAnswers(t *testing.T) {
+	resp := buildAnswer(40, 0) // 29 + 40*16 bytes
+	resp.SetEDNS(&EDNS{UDPSize: 1232})
+
+	out, err := resp.Truncate(MinUDPSize)
+	if err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	if len(out) > MinUDPSize {
+		t.Errorf("truncated message is %d bytes", len(out))
+	}
+	var m Msg
+	if err := m.Unpack(out); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !m.Truncated() {
+		t.Error("TC bit is not set")
+	}
+
+	if len(m.Answer) == 0 || len(m.Answer) >= 40 {
+		t.Errorf("unexpected ANCOUNT %d", len(m.Answer))
+	}
+	if (len(out)-29-11)%16 != 0 {
+		t.Errorf("message was not cut at a record boundary: %d bytes", len(out))
+	}
+
+	opt, err := m.EDNS()
+	if err != nil || opt == nil {
+		t.Errorf("OPT record was lost: %v", err)
+	}
+	if len(resp.Answer) != 40 {
+		t.Error("Truncate changed the message it was given")
+	}
+}
+
+func TestTruncateAdditionalOnly(t *testing.T) {
+	out, err := buildAnswer(2, 40).Truncate(MinUDPSize)
+	if err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	var m Msg
+	if err := m.Unpack(out); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if m.Truncated() {
+		t.Error("TC must not be set when only additional records are dropped")
+	}
+	if len(m.Answer) != 2 {
+		t.Errorf("ANCOUNT expected 2, got %d", len(m.Answer))
+	}
+	if len(m.Additional) == 0 || len(m.Additional) >= 40 {
+		t.Errorf("unexpected ARCOUNT %d", len(m.Additional))
+	}
+}
@@ -0,0 +1,134 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+var (
+	ErrMismatchedResponse = errors.New("response doesn't match the query")
+	// ErrCaseMismatch is a response that only differs from the query in the
+	// case of a question name. Either the upstream doesn't echo the 0x20
+	// spelling or the response is forged.
+	ErrCaseMismatch = fmt.Errorf("%w: case of the question differs", ErrMismatchedResponse)
+)
+
+// ValidateResponse checks that resp answers query: the ID matches, QR is set
+// and the question section is the same, including the case of the names. A
+// response that is only off in case fails with ErrCaseMismatch.
+func ValidateResponse(query, resp *Msg) error {
+	if query.Header.ID != resp.Header.ID {
+		return fmt.Errorf("%w: ID differs", ErrMismatchedResponse)
+	}
+	if (resp.Header.Flags>>QRBit)&1 != 1 {
+		return fmt.Errorf("%w: QR bit is not set", ErrMismatchedResponse)
+	}
+	if len(query.Question) != len(resp.Question) {
+		return fmt.Errorf("%w: QDCOUNT differs", ErrMismatchedResponse)
+	}
+
+	var caseErr error
+	for i, q := range query.Question {
+		r := resp.Question[i]
+		if len(q.Name) != len(r.Name) || !strings.EqualFold(q.Name, r.Name) {
+			return fmt.Errorf("%w: question name %q, got %q", ErrMismatchedResponse, q.Name, r.Name)
+		}
+		if q.Type != r.Type || q.Class != r.Class {
+			return fmt.Errorf("%w: question type or class differs", ErrMismatchedResponse)
+		}
+		if q.Name != r.Name && caseErr == nil {
+			caseErr = fmt.Errorf("%w: asked %q, got %q", ErrCaseMismatch, q.Name, r.Name)
+		}
+	}
+
+	return caseErr
+}
+
+// RandomizeCase flips the case of the letters in the question names of m at
+// random (0x20 encoding), which makes forged answers harder to guess.
+func (m *Msg) RandomizeCase() {
+	for i := range m.Question {
+		name := []byte(m.Question[i].Name)
+		for j, c := range name {
+			if lower := c | 0x20; lower >= 'a' && lower <= 'z' && rand.IntN(2) == 1 {
+				name[j] ^= 0x20
+			}
+		}
+		m.Question[i].Name = string(name)
+	}
+}
+
+// RestoreQuery gives m the ID and question spelling of the client's query
+// after it was forwarded with a random ID and case. Owner and RDATA names
+// that repeat the random spelling get the client's one too, as they did when
+// they were compressed against the question. Both question sections must be
+// equal ignoring case, otherwise only the ID is restored.
+func (m *Msg) RestoreQuery(query *Msg) {
+	m.Header.ID = query.Header.ID
+
+	if len(m.Question) != len(query.Question) {
+		return
+	}
+	for i, q := range query.Question {
+		if len(m.Question[i].Name) != len(q.Name) || !strings.EqualFold(m.Question[i].Name, q.Name) {
+			return
+		}
+	}
+
+	for i, q := range query.Question {
+		from := m.Question[i].Name
+		if from == q.Name {
+			continue
+		}
+		m.Question[i].Name = q.Name
+		for _, section := range [][]ResourceRecord{m.Answer, m.Authority, m.Additional} {
+			for j := range section {
+				section[j].Name = respell(section[j].Name, from, q.Name)
+				section[j].Data = respellRDATA(section[j], from, q.Name)
+			}
+		}
+	}
+}
+
+// respell replaces the part of name spelled as a label suffix of from with
+// the same labels of to. from and to differ only in case.
+func respell(name, from, to string) string {
+	for suffix := from; ; {
+		if strings.HasSuffix(name, suffix) && (len(name) == len(suffix) || name[len(name)-len(suffix)-1] == '.') {
+			return name[:len(name)-len(suffix)] + to[len(to)-len(suffix):]
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			return name
+		}
+		suffix = suffix[i+1:]
+	}
+}
+
+// respellRDATA is respell for the names held in the RDATA of rr. The RDATA is
+// copied when a name changes, it may be shared with other messages.
+func respellRDATA(rr ResourceRecord, from, to string) []byte {
+	prefix, names := rdataNames(rr.Type)
+	if names == 0 || len(rr.Data) < prefix {
+		return rr.Data
+	}
+
+	out := append([]byte(nil), rr.Data[:prefix]...)
+	offset, changed := prefix, false
+	for range names {
+		name, next, err := readName(rr.Data, offset, rr.Data)
+		if err != nil {
+			return rr.Data
+		}
+		spelled := respell(name, from, to)
+		changed = changed || spelled != name
+		out = appendName(out, spelled)
+		offset = next
+	}
+	if !changed {
+		return rr.Data
+	}
+	return append(out, rr.Data[offset:]...)
+}
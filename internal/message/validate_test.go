@@ -0,0 +1,93 @@
+package message
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateResponse(t *testing.T) {
+	query := exampleMsg(t)
+	if err := ValidateResponse(query, buildAnswer(1, 0)); err != nil {
+		t.Fatalf("valid response rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(resp *Msg)
+	}{
+		{"wrong ID", func(resp *Msg) { resp.Header.ID++ }},
+		{"QR not set", func(resp *Msg) { resp.Header.Flags &^= 1 << QRBit }},
+		{"other name", func(resp *Msg) { resp.Question[0].Name = "xxample.com" }},
+		{"name case", func(resp *Msg) { resp.Question[0].Name = "Example.com" }},
+		{"other type", func(resp *Msg) { resp.Question[0].Type = AAAA }},
+		{"no question", func(resp *Msg) { resp.Question = nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forged := buildAnswer(1, 0)
+			tt.change(forged)
+
+			err := ValidateResponse(query, forged)
+			if !errors.Is(err, ErrMismatchedResponse) {
+				t.Errorf("expected ErrMismatchedResponse, got %v", err)
+			}
+			// только расхождение в регистре можно простить без 0x20
+			if caseOnly := tt.name == "name case"; errors.Is(err, ErrCaseMismatch) != caseOnly {
+				t.Errorf("ErrCaseMismatch expected %v, got %v", caseOnly, err)
+			}
+		})
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	original := exampleMsg(t)
+
+	changed := false
+	for range 20 {
+		query := exampleMsg(t)
+		query.RandomizeCase()
+
+		if query.Header != original.Header || query.Question[0].Type != original.Question[0].Type {
+			t.Fatal("RandomizeCase touched more than the question name")
+		}
+		if !strings.EqualFold(query.Question[0].Name, original.Question[0].Name) {
+			t.Fatalf("name changed beyond its case: %q", query.Question[0].Name)
+		}
+		if query.Question[0].Name != original.Question[0].Name {
+			changed = true
+		}
+	}
+
+	if !changed {
+		t.Error("case of the name was never randomized")
+	}
+}
+
+func TestRestoreQuery(t *testing.T) {
+	query := exampleMsg(t)
+
+	resp := buildAnswer(1, 0)
+	resp.Header.ID = 0x9999
+	resp.Question[0].Name = "ExAmPlE.cOm"
+	// раньше эти имена были указателями на вопрос и менялись вместе с ним
+	resp.Answer[0].Name = "ExAmPlE.cOm"
+	resp.Answer = append(resp.Answer, ResourceRecord{Name: "www.ExAmPlE.cOm", Type: CNAME, Class: IN, TTL: 60, Data: appendName(nil, "cdn.cOm")})
+	resp.RestoreQuery(query)
+	if resp.Header.ID != query.Header.ID || resp.Question[0].Name != query.Question[0].Name {
+		t.Errorf("query not restored: %+v", resp)
+	}
+	if resp.Answer[0].Name != "example.com" || resp.Answer[1].Name != "www.example.com" {
+		t.Errorf("owner names not restored: %q %q", resp.Answer[0].Name, resp.Answer[1].Name)
+	}
+	if target, _ := resp.Answer[1].Target(); target != "cdn.com" {
+		t.Errorf("CNAME target not restored: %q", target)
+	}
+
+	resp.Question[0].Name = "other.com"
+	resp.RestoreQuery(query)
+	if resp.Question[0].Name != "other.com" {
+		t.Error("question of another name was overwritten")
+	}
+}
@@ -0,0 +1,445 @@
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+	"github.com/Vladroon22/DNS-Server/internal/upstream"
+)
+
+var (
+	ErrNoServers = errors.New("no name server answered")
+	ErrLoop      = errors.New("resolution loop")
+	ErrTooDeep   = errors.New("resolution limit exceeded")
+)
+
+// DefaultRootHints are the IPv4 addresses of a.root-servers.net through
+// m.root-servers.net.
+const DefaultRootHints = "198.41.0.4,170.247.170.2,192.33.4.12,199.7.91.13,192.203.230.10,192.5.5.241," +
+	"192.112.36.4,198.97.190.53,192.36.148.17,192.58.128.30,193.0.14.129,199.7.83.42,202.12.27.33"
+
+const (
+	defaultPort       = "53"
+	defaultTimeout    = 2 * time.Second
+	defaultMaxDepth   = 6
+	defaultMaxQueries = 64
+
+	maxCNAMEs    = 8
+	maxReferrals = 32
+	maxZones     = 10000
+	querySize    = 1232
+)
+
+type Config struct {
+	RootHints  []string      // root server addresses, the port defaults to Port
+	Port       string        // port of the name servers learned from referrals
+	Timeout    time.Duration // for a single name server query
+	MaxDepth   int           // nested lookups of CNAME targets and name server addresses
+	MaxQueries int           // name server queries one client query may cost
+}
+
+// Resolver answers queries itself by walking down from the root servers. It
+// implements upstream.Upstream so it can stand in for forwarding.
+type Resolver struct {
+	cfg   Config
+	roots []string
+	mtx   sync.RWMutex
+	zones map[string]delegation
+}
+
+// delegation is a cached referral: the addresses of the servers of a zone.
+type delegation struct {
+	servers []string
+	exp     time.Time
+}
+
+// result is what the authoritative servers said about one name.
+type result struct {
+	rcode     uint8
+	answer    []message.ResourceRecord
+	authority []message.ResourceRecord
+}
+
+// state is shared by everything one client query sets off.
+type state struct {
+	queries  int
+	visiting map[string]bool
+}
+
+func New(cfg Config) (*Resolver, error) {
+	if cfg.Port == "" {
+		cfg.Port = defaultPort
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.MaxDepth <= 0 {
+		cfg.MaxDepth = defaultMaxDepth
+	}
+	if cfg.MaxQueries <= 0 {
+		cfg.MaxQueries = defaultMaxQueries
+	}
+
+	r := &Resolver{cfg: cfg, zones: make(map[string]delegation)}
+	for _, hint := range cfg.RootHints {
+		hint = strings.TrimSpace(hint)
+		if hint == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(hint); err != nil {
+			hint = net.JoinHostPort(hint, cfg.Port)
+		}
+		r.roots = append(r.roots, hint)
+	}
+
+	if len(r.roots) == 0 {
+		return nil, fmt.Errorf("no root hints configured")
+	}
+	return r, nil
+}
+
+func (r *Resolver) Address() string {
+	return "recursive"
+}
+
+func (r *Resolver) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var query message.Msg
+	if err := query.Unpack(msg); err != nil {
+		return nil, err
+	}
+	if len(query.Question) == 0 {
+		return nil, fmt.Errorf("%w: no question", message.ErrFormatError)
+	}
+
+	st := &state{queries: r.cfg.MaxQueries, visiting: make(map[string]bool)}
+	res, err := r.resolve(ctx, st, query.Question[0], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// the records are spelled the way the recursor asked, give the client
+	// back its own spelling
+	resp := query.Reply(res.rcode)
+	resp.Question = []message.Question{{Name: canonical(query.Question[0].Name), Type: query.Question[0].Type, Class: query.Question[0].Class}}
+	resp.Answer, resp.Authority = res.answer, res.authority
+	resp.RestoreQuery(&message.Msg{Header: query.Header, Question: query.Question[:1]})
+	if opt, err := query.EDNS(); err == nil && opt != nil {
+		resp.SetEDNS(&message.EDNS{UDPSize: querySize})
+	}
+	return resp.Pack()
+}
+
+// resolve answers que, following CNAMEs that lead out of the zone that
+// answered.
+func (r *Resolver) resolve(ctx context.Context, st *state, que message.Question, depth int) (*result, error) {
+	if depth > r.cfg.MaxDepth {
+		return nil, fmt.Errorf("%w: nested lookups for %s", ErrTooDeep, que.Name)
+	}
+
+	key := fmt.Sprintf("%s/%d", strings.ToLower(que.Name), que.Type)
+	if st.visiting[key] {
+		return nil, fmt.Errorf("%w: %s is needed to resolve itself", ErrLoop, que.Name)
+	}
+	st.visiting[key] = true
+	defer delete(st.visiting, key)
+
+	var chain []message.ResourceRecord
+	seen := map[string]bool{strings.ToLower(que.Name): true}
+	name := que.Name
+
+	for range maxCNAMEs {
+		res, err := r.lookup(ctx, st, message.Question{Name: name, Type: que.Type, Class: que.Class}, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		records, next := followChain(name, que.Type, res.answer)
+		chain = append(chain, records...)
+		if next == "" || res.rcode != message.RcodeSuccess {
+			res.answer = chain
+			return res, nil
+		}
+
+		if seen[strings.ToLower(next)] {
+			return nil, fmt.Errorf("%w: CNAME chain of %s returns to %s", ErrLoop, que.Name, next)
+		}
+		seen[strings.ToLower(next)] = true
+		name = next
+	}
+
+	return nil, fmt.Errorf("%w: CNAME chain of %s is too long", ErrTooDeep, que.Name)
+}
+
+// followChain picks the records answering name and qtype out of answer,
+// going through CNAMEs. next is the name the chain continues with when answer
+// ends in a CNAME whose target it has no records for.
+func followChain(name string, qtype message.QType, answer []message.ResourceRecord) ([]message.ResourceRecord, string) {
+	var chain []message.ResourceRecord
+	start := name
+
+	for range maxCNAMEs + 1 {
+		var found, cname []message.ResourceRecord
+		for _, rr := range answer {
+			if !message.EqualNames(rr.Name, name) {
+				continue
+			}
+			switch {
+			case rr.Type == qtype:
+				found = append(found, rr)
+			case rr.Type == message.CNAME:
+				cname = append(cname, rr)
+			}
+		}
+
+		if len(found) > 0 || len(cname) == 0 {
+			chain = append(chain, found...)
+			break
+		}
+
+		target, err := cname[0].Target()
+		if err != nil {
+			break
+		}
+		chain = append(chain, cname[0])
+		name = target
+	}
+
+	if len(chain) > 0 && chain[len(chain)-1].Type == message.CNAME && !message.EqualNames(name, start) {
+		return chain, name
+	}
+	return chain, ""
+}
+
+// lookup walks the delegations from the closest known zone down to the
+// servers that are authoritative for que.
+func (r *Resolver) lookup(ctx context.Context, st *state, que message.Question, depth int) (*result, error) {
+	zone, servers := r.closest(que.Name)
+
+	for range maxReferrals {
+		sec, err := r.query(ctx, st, servers, que)
+		if err != nil {
+			return nil, err
+		}
+		res := &result{rcode: sec.Rcode(), answer: sec.Answer, authority: sec.Authority}
+
+		authoritative := (sec.Header.Flags>>message.AABit)&1 == 1
+		if authoritative || len(sec.Answer) > 0 || res.rcode != message.RcodeSuccess {
+			return res, nil
+		}
+
+		child, nsNames, ttl := referral(sec.Authority, que.Name, zone)
+		if child == "" {
+			// neither an answer nor a way closer to it, take it as NODATA
+			return res, nil
+		}
+
+		addrs := r.glue(sec.Additional, nsNames, zone)
+		if len(addrs) == 0 {
+			addrs = r.resolveNS(ctx, st, nsNames, depth+1)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("%w: no address for the servers of %s", ErrNoServers, child)
+		}
+
+		r.store(child, addrs, ttl)
+		zone, servers = child, addrs
+	}
+
+	return nil, fmt.Errorf("%w: too many referrals for %s", ErrTooDeep, que.Name)
+}
+
+// referral finds the delegation in authority that gets closer to name than
+// zone. Upward and sideways referrals are ignored, which keeps a lame server
+// from sending us in circles.
+func referral(authority []message.ResourceRecord, name, zone string) (string, []string, uint32) {
+	var (
+		child string
+		names []string
+		ttl   uint32
+	)
+
+	for _, rr := range authority {
+		if rr.Type != message.NS {
+			continue
+		}
+		owner := canonical(rr.Name)
+		if owner == zone || !message.InBailiwick(owner, zone) || !message.InBailiwick(name, owner) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+
+		target, err := rr.Target()
+		if err != nil {
+			continue
+		}
+		if child == "" || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		child = owner
+		names = append(names, target)
+	}
+
+	return child, names, ttl
+}
+
+// glue returns the addresses from additional for the servers in nsNames.
+// Only records the parent zone is authoritative for are trusted.
+func (r *Resolver) glue(additional []message.ResourceRecord, nsNames []string, zone string) []string {
+	var v4, v6 []string
+	for _, rr := range additional {
+		if !message.InBailiwick(rr.Name, zone) || message.CheckRDATA(rr) != nil {
+			continue
+		}
+
+		for _, ns := range nsNames {
+			if !message.EqualNames(rr.Name, ns) {
+				continue
+			}
+			switch rr.Type {
+			case message.A:
+				v4 = append(v4, net.JoinHostPort(net.IP(rr.Data).String(), r.cfg.Port))
+			case message.AAAA:
+				v6 = append(v6, net.JoinHostPort(net.IP(rr.Data).String(), r.cfg.Port))
+			}
+		}
+	}
+	return append(v4, v6...)
+}
+
+// resolveNS looks up the addresses of name servers that came without glue.
+// The first server that resolves is enough.
+func (r *Resolver) resolveNS(ctx context.Context, st *state, nsNames []string, depth int) []string {
+	for _, ns := range nsNames {
+		res, err := r.resolve(ctx, st, message.Question{Name: ns, Type: message.A, Class: message.IN}, depth)
+		if err != nil {
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range res.answer {
+			if rr.Type == message.A && message.CheckRDATA(rr) == nil {
+				addrs = append(addrs, net.JoinHostPort(net.IP(rr.Data).String(), r.cfg.Port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// query asks servers one after another until one of them answers que.
+func (r *Resolver) query(ctx context.Context, st *state, servers []string, que message.Question) (*message.Msg, error) {
+	lastErr := fmt.Errorf("%w for %s", ErrNoServers, que.Name)
+
+	for _, i := range rand.Perm(len(servers)) {
+		if st.queries <= 0 {
+			return nil, fmt.Errorf("%w: query budget spent on %s", ErrTooDeep, que.Name)
+		}
+		st.queries--
+
+		plain := buildQuery(que)
+		out := plain.Copy()
+		out.RandomizeCase()
+		msg, err := out.Pack()
+		if err != nil {
+			return nil, err
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+		data, err := upstream.NewUDP(servers[i], querySize).Exchange(qctx, msg)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("%s: %w", servers[i], err)
+			continue
+		}
+
+		var resp message.Msg
+		if err := resp.Unpack(data); err != nil {
+			lastErr = fmt.Errorf("%s: %w", servers[i], err)
+			continue
+		}
+		if err := message.ValidateResponse(out, &resp); err != nil {
+			lastErr = fmt.Errorf("%s: %w", servers[i], err)
+			continue
+		}
+		resp.RestoreQuery(plain)
+
+		switch rcode := resp.Rcode(); rcode {
+		case message.RcodeSuccess, message.RcodeNameError:
+			return &resp, nil
+		default:
+			lastErr = fmt.Errorf("%w: %s answered with rcode %d", ErrNoServers, servers[i], rcode)
+		}
+	}
+
+	return nil, lastErr
+}
+
+// buildQuery makes a non-recursive query for que with a random ID and the
+// name in canonical form. query randomizes its case before sending it.
+func buildQuery(que message.Question) *message.Msg {
+	query := &message.Msg{
+		Header:   message.Header{ID: uint16(rand.Uint32())},
+		Question: []message.Question{{Name: canonical(que.Name), Type: que.Type, Class: que.Class}},
+	}
+	query.SetEDNS(&message.EDNS{UDPSize: querySize})
+	return query
+}
+
+// closest returns the deepest cached zone above name and its servers,
+// falling back to the root.
+func (r *Resolver) closest(name string) (string, []string) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	now := time.Now()
+	for zone := canonical(name); zone != ""; {
+		if d, ok := r.zones[zone]; ok && now.Before(d.exp) {
+			return zone, d.servers
+		}
+
+		if dot := strings.IndexByte(zone, '.'); dot >= 0 {
+			zone = zone[dot+1:]
+		} else {
+			zone = ""
+		}
+	}
+
+	return "", r.roots
+}
+
+func (r *Resolver) store(zone string, servers []string, ttl uint32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	if len(r.zones) >= maxZones {
+		for z, d := range r.zones {
+			if !now.Before(d.exp) {
+				delete(r.zones, z)
+			}
+		}
+		if len(r.zones) >= maxZones {
+			r.zones = make(map[string]delegation)
+		}
+	}
+
+	r.zones[zone] = delegation{servers: servers, exp: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
@@ -0,0 +1,315 @@
+package recursor
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// reply is what a fake authoritative server says about a question.
+type reply struct {
+	rcode uint8
+	aa    bool
+	an    []message.ResourceRecord
+	ns    []message.ResourceRecord
+	ar    []message.ResourceRecord
+}
+
+type zoneFunc func(que message.Question) reply
+
+func wireName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+func rr(name string, typ message.QType, data []byte) message.ResourceRecord {
+	return message.ResourceRecord{Name: name, Type: typ, Class: message.IN, TTL: 300, Data: data}
+}
+
+func nsRR(zone, ns string) message.ResourceRecord {
+	return rr(zone, message.NS, wireName(ns))
+}
+
+func aRR(name string, ip string) message.ResourceRecord {
+	return rr(name, message.A, net.ParseIP(ip).To4())
+}
+
+// fakeTree runs one fake authoritative server per loopback address, all on
+// the same port, and counts the queries every one of them gets.
+type fakeTree struct {
+	port    string
+	queries map[string]*atomic.Int32
+}
+
+func startTree(t *testing.T, zones map[string]zoneFunc) *fakeTree {
+	t.Helper()
+
+	first, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(first.LocalAddr().String())
+	first.Close()
+
+	tree := &fakeTree{port: port, queries: make(map[string]*atomic.Int32)}
+	for ip, zone := range zones {
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Fatalf("listen %s: %v", ip, err)
+		}
+		t.Cleanup(func() { pc.Close() })
+
+		counter := &atomic.Int32{}
+		tree.queries[ip] = counter
+		go serveZone(pc, zone, counter)
+	}
+
+	return tree
+}
+
+func (tr *fakeTree) count(ip string) int32 {
+	return tr.queries[ip].Load()
+}
+
+func serveZone(pc net.PacketConn, zone zoneFunc, counter *atomic.Int32) {
+	buf := make([]byte, message.MaxTCPMsgSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		counter.Add(1)
+
+		var query message.Msg
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Question) == 0 {
+			continue
+		}
+		// авторитетные серверы не выполняют рекурсию
+		if (query.Header.Flags>>message.RDBit)&1 == 1 {
+			continue
+		}
+
+		rep := zone(query.Question[0])
+		reply := query.Reply(rep.rcode)
+		reply.Header.Flags &^= 1 << message.RABit
+		if rep.aa {
+			reply.Header.Flags |= 1 << message.AABit
+		}
+		reply.Answer, reply.Authority, reply.Additional = rep.an, rep.ns, rep.ar
+
+		resp, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(resp, addr)
+	}
+}
+
+// testZones is a small internet:
+//
+//	127.0.0.1  root, delegates com, net and loop.test, and example.org without glue
+//	127.0.0.2  com and net
+//	127.0.0.3  example.com, where www is a CNAME to web.other.net, and example.org
+//	127.0.0.4  other.net
+func testZones() map[string]zoneFunc {
+	return map[string]zoneFunc{
+		"127.0.0.1": func(que message.Question) reply {
+			switch {
+			case message.InBailiwick(que.Name, "com"):
+				return reply{ns: []message.ResourceRecord{nsRR("com", "a.gtld.test")}, ar: []message.ResourceRecord{aRR("a.gtld.test", "127.0.0.2")}}
+			case message.InBailiwick(que.Name, "net"):
+				return reply{ns: []message.ResourceRecord{nsRR("net", "a.gtld.test")}, ar: []message.ResourceRecord{aRR("a.gtld.test", "127.0.0.2")}}
+			case message.InBailiwick(que.Name, "example.org"):
+				return reply{ns: []message.ResourceRecord{nsRR("example.org", "ns1.example.com")}}
+			case message.InBailiwick(que.Name, "loop.test"):
+				return reply{ns: []message.ResourceRecord{nsRR("loop.test", "ns.loop.test")}}
+			}
+			return reply{rcode: message.RcodeNameError, aa: true}
+		},
+		"127.0.0.2": func(que message.Question) reply {
+			switch {
+			case message.InBailiwick(que.Name, "example.com"):
+				return reply{ns: []message.ResourceRecord{nsRR("example.com", "ns1.example.com")}, ar: []message.ResourceRecord{aRR("ns1.example.com", "127.0.0.3")}}
+			case message.InBailiwick(que.Name, "other.net"):
+				return reply{
+					ns: []message.ResourceRecord{nsRR("other.net", "ns.other.net")},
+					// чужой glue не должен попасть в кэш делегаций
+					ar: []message.ResourceRecord{aRR("ns.other.net", "127.0.0.4"), aRR("ns1.example.com", "127.0.0.66")},
+				}
+			}
+			return reply{rcode: message.RcodeNameError, aa: true}
+		},
+		"127.0.0.3": func(que message.Question) reply {
+			switch strings.ToLower(que.Name) {
+			case "www.example.com":
+				return reply{aa: true, an: []message.ResourceRecord{rr(que.Name, message.CNAME, wireName("web.other.net"))}}
+			case "ns1.example.com":
+				return reply{aa: true, an: []message.ResourceRecord{aRR(que.Name, "127.0.0.3")}}
+			case "a.example.com":
+				return reply{aa: true, an: []message.ResourceRecord{rr(que.Name, message.CNAME, wireName("b.example.com"))}}
+			case "b.example.com":
+				return reply{aa: true, an: []message.ResourceRecord{rr(que.Name, message.CNAME, wireName("a.example.com"))}}
+			case "www.example.org":
+				return reply{aa: true, an: []message.ResourceRecord{aRR(que.Name, "10.0.0.8")}}
+			}
+			soa := rr("example.com", message.SOA, append(append(wireName("ns1.example.com"), wireName("admin.example.com")...), make([]byte, 20)...))
+			return reply{rcode: message.RcodeNameError, aa: true, ns: []message.ResourceRecord{soa}}
+		},
+		"127.0.0.4": func(que message.Question) reply {
+			if strings.EqualFold(que.Name, "web.other.net") && que.Type == message.A {
+				return reply{aa: true, an: []message.ResourceRecord{aRR(que.Name, "10.0.0.7")}}
+			}
+			return reply{aa: true}
+		},
+	}
+}
+
+func newTestResolver(t *testing.T, tree *fakeTree) *Resolver {
+	t.Helper()
+
+	r, err := New(Config{RootHints: []string{"127.0.0.1"}, Port: tree.port, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r
+}
+
+func query(name string, qtype message.QType) []byte {
+	msg := []byte{0xBE, 0xEF, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, wireName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(qtype))
+	return binary.BigEndian.AppendUint16(msg, uint16(message.IN))
+}
+
+func TestResolveFollowsReferralsAndCNAMEs(t *testing.T) {
+	tree := startTree(t, testZones())
+	r := newTestResolver(t, tree)
+
+	q := query("www.example.com", message.A)
+	resp, err := r.Exchange(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	var sent, sec message.Msg
+	sent.Unpack(q)
+	if err := sec.Unpack(resp); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if err := message.ValidateResponse(&sent, &sec); err != nil {
+		t.Fatalf("reply doesn't match the query: %v", err)
+	}
+	if len(sec.Answer) != 2 || sec.Answer[0].Type != message.CNAME || !net.IP(sec.Answer[1].Data).Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("expected the CNAME and the address of its target, got %+v", sec.Answer)
+	}
+
+	// делегации закэшированы, корень больше не спрашиваем
+	roots := tree.count("127.0.0.1")
+	if _, err := r.Exchange(context.Background(), query("www.example.com", message.A)); err != nil {
+		t.Fatalf("second Exchange: %v", err)
+	}
+	if tree.count("127.0.0.1") != roots || tree.count("127.0.0.2") != 2 {
+		t.Errorf("delegations weren't reused: root %d→%d, gtld %d", roots, tree.count("127.0.0.1"), tree.count("127.0.0.2"))
+	}
+
+	if servers := r.zones["example.com"].servers; len(servers) != 1 || !strings.HasPrefix(servers[0], "127.0.0.3:") {
+		t.Errorf("out-of-bailiwick glue was used: %v", servers)
+	}
+}
+
+func TestResolveWithoutGlue(t *testing.T) {
+	tree := startTree(t, testZones())
+	r := newTestResolver(t, tree)
+
+	resp, err := r.Exchange(context.Background(), query("www.example.org", message.A))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	var sec message.Msg
+	sec.Unpack(resp)
+	if len(sec.Answer) != 1 || !net.IP(sec.Answer[0].Data).Equal(net.IPv4(10, 0, 0, 8)) {
+		t.Fatalf("unexpected answer %+v", sec.Answer)
+	}
+	// регистр 0x20 не должен доходить до клиента
+	if sec.Answer[0].Name != "www.example.org" {
+		t.Errorf("answer owner spelled %q", sec.Answer[0].Name)
+	}
+}
+
+func TestResolveNXDomain(t *testing.T) {
+	tree := startTree(t, testZones())
+	r := newTestResolver(t, tree)
+
+	resp, err := r.Exchange(context.Background(), query("missing.example.com", message.A))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	var sec message.Msg
+	if err := sec.Unpack(resp); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if rcode := sec.Rcode(); rcode != message.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got rcode %d", rcode)
+	}
+	if len(sec.Authority) != 1 || sec.Authority[0].Type != message.SOA {
+		t.Error("SOA from the authority section was lost")
+	}
+}
+
+func TestResolveLoops(t *testing.T) {
+	tree := startTree(t, testZones())
+	r := newTestResolver(t, tree)
+
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"a.example.com", ErrLoop},
+		{"www.loop.test", ErrNoServers},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if _, err := r.Exchange(ctx, query(tt.name, message.A)); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestQueryBudget(t *testing.T) {
+	tree := startTree(t, map[string]zoneFunc{
+		// каждый ответ — новая делегация без адресов
+		"127.0.0.1": func(que message.Question) reply {
+			return reply{ns: []message.ResourceRecord{nsRR("test", "ns."+que.Name)}}
+		},
+	})
+
+	r, err := New(Config{RootHints: []string{"127.0.0.1"}, Port: tree.port, Timeout: time.Second, MaxQueries: 10})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := r.Exchange(context.Background(), query("www.test", message.A)); err == nil {
+		t.Fatal("expected the resolution to fail")
+	}
+	if n := tree.count("127.0.0.1"); n > 10 {
+		t.Errorf("%d queries sent, the budget is 10", n)
+	}
+}
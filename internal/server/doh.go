@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// StartHTTPS serves DNS-over-HTTPS (RFC 8484) on the configured path.
+func (s *Server) StartHTTPS() error {
+	tlsConfig, err := s.loadTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.ListenTCP("tcp", s.dohAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.dohPath, s.serveDoH)
+
+	s.httpServer = &http.Server{
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       s.tlsIdleTimeout,
+	}
+	s.dohListener = ln
+
+	go func() {
+		if err := s.httpServer.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("DoH server: %v", err)})
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	query, status, err := readDoHQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+	defer cancel()
+
+	response, err := s.handleQuery(ctx, query, ip)
+	if err != nil {
+		response = s.errorResponse(query, err)
+	}
+	if response == nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	maxAge := uint32(0)
+	if ttl, ok := response.MinAnswerTTL(); ok {
+		maxAge = ttl
+	}
+
+	out := s.packReply(query, response, message.MaxTCPMsgSize)
+	if out == nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	if _, err := w.Write(out); err != nil {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("DoH write: %v", err)})
+	}
+}
+
+// readDoHQuery extracts the wire-format query from a GET or POST request and
+// returns the HTTP status to use if it can't.
+func readDoHQuery(r *http.Request) ([]byte, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, errors.New("missing dns parameter")
+		}
+
+		query, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("dns parameter is not base64url")
+		}
+		return query, http.StatusOK, nil
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content type must be %s", dnsMessageType)
+		}
+
+		query, err := io.ReadAll(io.LimitReader(r.Body, message.MaxTCPMsgSize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(query) > message.MaxTCPMsgSize {
+			return nil, http.StatusRequestEntityTooLarge, errors.New("DNS message is too long")
+		}
+		return query, http.StatusOK, nil
+
+	default:
+		return nil, http.StatusMethodNotAllowed, errors.New("only GET and POST are allowed")
+	}
+}
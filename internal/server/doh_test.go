@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+func startDoHServer(t *testing.T) (*Server, *http.Client) {
+	t.Helper()
+
+	ca := newTestCA(t)
+	cfg := testConfig()
+	cfg.DoHPath = "/dns-query"
+	cfg.TLSCertFile, cfg.TLSKeyFile = ca.issue(t, x509.ExtKeyUsageServerAuth)
+
+	srv := startTestServer(t, cfg)
+	if err := srv.StartHTTPS(); err != nil {
+		t.Fatalf("StartHTTPS: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.pool, ServerName: "localhost"},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	t.Cleanup(client.CloseIdleConnections)
+
+	return srv, client
+}
+
+func checkDoHAnswer(t *testing.T, resp *http.Response, id uint16) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "max-age=") {
+		t.Errorf("unexpected Cache-Control %q", cc)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	var msg message.Msg
+	if err := msg.Unpack(body); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if msg.Header.ID != id || len(msg.Answer) != 1 {
+		t.Errorf("unexpected answer header: %+v", msg.Header)
+	}
+}
+
+func TestDoHPost(t *testing.T) {
+	srv, client := startDoHServer(t)
+	url := "https://" + srv.dohListener.Addr().String() + "/dns-query"
+
+	resp, err := client.Post(url, dnsMessageType, bytes.NewReader(buildQuery(0, "example.com", 1)))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	checkDoHAnswer(t, resp, 0)
+}
+
+func TestDoHGet(t *testing.T) {
+	srv, client := startDoHServer(t)
+	param := base64.RawURLEncoding.EncodeToString(buildQuery(0xABCD, "example.com", 1))
+	url := "https://" + srv.dohListener.Addr().String() + "/dns-query?dns=" + param
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	checkDoHAnswer(t, resp, 0xABCD)
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	srv, client := startDoHServer(t)
+	url := "https://" + srv.dohListener.Addr().String() + "/dns-query"
+
+	tests := []struct {
+		name   string
+		do     func() (*http.Response, error)
+		status int
+	}{
+		{"wrong content type", func() (*http.Response, error) {
+			return client.Post(url, "text/plain", strings.NewReader("example.com"))
+		}, http.StatusUnsupportedMediaType},
+		{"missing parameter", func() (*http.Response, error) {
+			return client.Get(url)
+		}, http.StatusBadRequest},
+		{"padded base64", func() (*http.Response, error) {
+			return client.Get(url + "?dns=" + base64.URLEncoding.EncodeToString([]byte{1, 2, 3, 4}))
+		}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.do()
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
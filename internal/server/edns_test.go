@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// withEDNS adds opt to the wire-format query.
+func withEDNS(t *testing.T, query []byte, opt *message.EDNS) []byte {
+	t.Helper()
+
+	var m message.Msg
+	if err := m.Unpack(query); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	m.SetEDNS(opt)
+	out, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return out
+}
+
+func TestEDNSReplyOnCachedAnswer(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+
+	query := withEDNS(t, buildQuery(0x1111, "example.com", 1), &message.EDNS{UDPSize: 4096, DO: true})
+
+	resp, err := srv.handleQuery(context.Background(), query, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("handleQuery: %v", err)
+	}
+
+	opt, err := resp.EDNS()
+	if err != nil {
+		t.Fatalf("EDNS: %v", err)
+	}
+	if opt == nil {
+		t.Fatal("reply has no OPT record")
+	}
+	if opt.UDPSize != 1232 {
+		t.Errorf("advertised payload size expected 1232, got %d", opt.UDPSize)
+	}
+	if !opt.DO {
+		t.Error("DO bit is not echoed")
+	}
+}
+
+func TestEDNSBadVersion(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+
+	query := withEDNS(t, buildQuery(0x2222, "example.com", 1), &message.EDNS{UDPSize: 1232, Version: 1})
+
+	_, err := srv.handleQuery(context.Background(), query, "127.0.0.1")
+	if err == nil {
+		t.Fatal("expected BADVERS error")
+	}
+
+	resp := srv.errorResponse(query, err)
+	opt, err := resp.EDNS()
+	if err != nil || opt == nil {
+		t.Fatalf("BADVERS reply must carry an OPT record: %v", err)
+	}
+
+	rcode := uint16(opt.ExtRcode)<<4 | uint16(resp.Rcode())
+	if rcode != uint16(message.RcodeBadVersion) {
+		t.Errorf("extended RCODE expected %d, got %d", message.RcodeBadVersion, rcode)
+	}
+}
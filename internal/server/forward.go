@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/Vladroon22/DNS-Server/internal/config"
+	"github.com/Vladroon22/DNS-Server/internal/forward"
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/suffix"
+	"github.com/Vladroon22/DNS-Server/internal/to_google"
+	"github.com/Vladroon22/DNS-Server/internal/upstream"
+)
+
+type route struct {
+	rcv     *to_google.DNSReceiver
+	noCache bool
+}
+
+// loadRoutes builds the conditional forwarding table. Rules naming the same
+// upstreams share one pool, so health tracking covers all of them.
+func (s *Server) loadRoutes(cfg *config.Config, poolCfg upstream.PoolConfig) error {
+	rules, err := forward.LoadRules(cfg.ForwardRules, cfg.ForwardRulesFile)
+	if err != nil {
+		return err
+	}
+
+	s.routes = suffix.NewTable[route]()
+	pools := make(map[string]*upstream.Pool)
+	receivers := make(map[string]*to_google.DNSReceiver)
+
+	for _, rule := range rules {
+		key := fmt.Sprintf("%s %t", rule.Upstreams, rule.NoCache)
+		rcv, ok := receivers[key]
+		if !ok {
+			pool, ok := pools[rule.Upstreams]
+			if !ok {
+				upstreams, err := upstream.ParseList(rule.Upstreams, s.ednsSize)
+				if err != nil {
+					return fmt.Errorf("forwarding rule for %s: %w", rule.Suffix, err)
+				}
+				pool = upstream.NewPool(upstreams, poolCfg)
+				pools[rule.Upstreams] = pool
+				s.forwardPools = append(s.forwardPools, pool)
+			}
+
+			che := s.cache
+			if rule.NoCache {
+				che = nil
+			}
+			rcv = to_google.NewDNSReceiver(che, pool, s.ednsSize, s.logger)
+			receivers[key] = rcv
+			s.forwardRcvs = append(s.forwardRcvs, rcv)
+		}
+
+		if !s.routes.Add(rule.Suffix, route{rcv: rcv, noCache: rule.NoCache}) {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Duplicate forwarding rule for %s ignored", rule.Suffix)})
+		}
+	}
+
+	return nil
+}
+
+// route picks the receiver for name: the forwarding rule with the longest
+// matching suffix, or the default upstreams.
+func (s *Server) route(name string) route {
+	def := route{rcv: s.upstream}
+	if s.routes == nil || s.routes.Len() == 0 {
+		return def
+	}
+
+	if r, _, ok := s.routes.Lookup(name); ok {
+		return r
+	}
+	return def
+}
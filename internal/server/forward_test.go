@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// startAnsweringUpstream answers every A query over UDP with ip. Queries
+// must not carry an OPT record.
+func startAnsweringUpstream(t *testing.T, ip net.IP) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, message.MaxTCPMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := append([]byte(nil), buf[:n]...)
+			binary.BigEndian.PutUint16(resp[2:4], 0x8180)
+			binary.BigEndian.PutUint16(resp[6:8], 1)
+			resp = append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 1, 0x2C, 0, 4)
+			pc.WriteTo(append(resp, ip.To4()...), addr)
+		}
+	}()
+
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestConditionalForwarding(t *testing.T) {
+	corp := startAnsweringUpstream(t, net.IPv4(10, 0, 0, 1))
+	rev := startAnsweringUpstream(t, net.IPv4(10, 0, 0, 2))
+	public := startAnsweringUpstream(t, net.IPv4(1, 2, 3, 4))
+
+	cfg := testConfig()
+	cfg.Upstreams = public
+	cfg.ForwardRules = "corp.example " + corp + " nocache; 10.in-addr.arpa " + rev + "; dev.corp.example " + rev
+
+	srv := startTestServer(t, cfg)
+
+	tests := []struct {
+		name   string
+		want   net.IP
+		cached bool
+	}{
+		{"host.corp.example", net.IPv4(10, 0, 0, 1), false},
+		{"HOST.Corp.Example", net.IPv4(10, 0, 0, 1), false},
+		{"box.dev.corp.example", net.IPv4(10, 0, 0, 2), true},
+		{"1.0.0.10.in-addr.arpa", net.IPv4(10, 0, 0, 2), true},
+		{"public.example", net.IPv4(1, 2, 3, 4), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := srv.handleQuery(context.Background(), buildQuery(7, tt.name, 1), "127.0.0.1")
+			if err != nil {
+				t.Fatalf("handleQuery: %v", err)
+			}
+			if len(resp.Answer) != 1 || !net.IP(resp.Answer[0].Data).Equal(tt.want) {
+				t.Errorf("expected an answer from the upstream for %v, got %+v", tt.want, resp.Answer)
+			}
+
+			if _, ok := srv.cache.Get(cache.NewKey(tt.name, 1, 1)); ok != tt.cached {
+				t.Errorf("cached = %v, expected %v", ok, tt.cached)
+			}
+		})
+	}
+}
+
+func TestBadForwardingRule(t *testing.T) {
+	cfg := testConfig()
+	cfg.ForwardRules = "corp.example ftp://10.0.0.1"
+
+	if _, err := DNSServer(cfg, nil); err == nil {
+		t.Error("rule with an unsupported upstream was accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// handleQuery runs a single wire-format query through the rate limiter,
+// message parsing, the cache and the upstream resolvers. It is shared by
+// every transport.
+func (s *Server) handleQuery(ctx context.Context, query []byte, ip string) (*message.Msg, error) {
+	if isBanned, reason := s.limit.ProcessIP(ip); isBanned {
+		return nil, fmt.Errorf("%w: %s", message.ErrRefused, reason)
+	}
+
+	var q message.Msg
+	if err := q.Unpack(query); err != nil {
+		return nil, queryError(err)
+	}
+	if err := q.Header.Check(); err != nil {
+		return nil, queryError(err)
+	}
+
+	opt, err := q.EDNS()
+	if err != nil {
+		return nil, queryError(err)
+	}
+	if opt != nil && opt.Version != 0 {
+		return nil, message.ErrBadVersion
+	}
+
+	s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Request header: %v", q.Header)})
+	s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("questions: %v", q.Question)})
+
+	route := s.route(q.Question[0].Name)
+
+	if !route.noCache {
+		if resp, err := s.cachedAnswer(&q, opt, false); err == nil {
+			return resp, nil
+		}
+	}
+
+	GoogleAnswer, err := s.forward(ctx, route, &q, query, opt)
+	if err != nil {
+		return nil, err
+	}
+	GoogleAnswer.SetPayloadSize(uint16(s.ednsSize))
+
+	s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Google: %v", GoogleAnswer)})
+
+	return GoogleAnswer, nil
+}
+
+// cachedAnswer builds the reply to q when every question is answered from
+// the cache. With stale set expired records in the stale window are used too.
+func (s *Server) cachedAnswer(q *message.Msg, opt *message.EDNS, stale bool) (*message.Msg, error) {
+	resp, ok := message.AnswerFromCache(q, s.cache, stale)
+	if !ok {
+		return nil, fmt.Errorf("%v is not cached", q.Question)
+	}
+	resp.SetEDNS(s.replyEDNS(opt, 0))
+
+	s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Cache questions: %v", q.Question)})
+
+	return resp, nil
+}
+
+// queryError marks a failure to parse the client's query as FORMERR unless it
+// already maps to a more specific response code.
+func queryError(err error) error {
+	if message.Rcode(err) != message.RcodeServerFailure {
+		return err
+	}
+	return fmt.Errorf("%w: %v", message.ErrFormatError, err)
+}
+
+// errorResponse logs err and turns it into a DNS reply for query. It returns
+// nil when the query is too broken to be answered at all.
+func (s *Server) errorResponse(query []byte, err error) *message.Msg {
+	s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
+
+	// a query that breaks off after its header still gets an answer
+	var q message.Msg
+	if q.Unpack(query) != nil && len(query) < 12 {
+		return nil
+	}
+
+	rcode := message.Rcode(err)
+	resp := message.ErrorReply(&q, rcode)
+	if opt, err := q.EDNS(); err == nil {
+		resp.SetEDNS(s.replyEDNS(opt, rcode))
+	}
+	return resp
+}
+
+// fitUDP packs response for the UDP payload size accepted by the client that
+// sent query.
+func (s *Server) fitUDP(query []byte, response *message.Msg) []byte {
+	var q message.Msg
+	q.Unpack(query)
+	opt, _ := q.EDNS()
+
+	return s.packReply(query, response, opt.PayloadSize(s.ednsSize))
+}
+
+// packReply packs response into at most limit bytes. A reply that can't be
+// packed is replaced by SERVFAIL; nil means there is nothing to send.
+func (s *Server) packReply(query []byte, response *message.Msg, limit int) []byte {
+	out, err := response.Truncate(limit)
+	if err == nil {
+		return out
+	}
+
+	if response = s.errorResponse(query, fmt.Errorf("can't pack reply: %v", err)); response == nil {
+		return nil
+	}
+	out, _ = response.Truncate(limit)
+	return out
+}
+
+// replyEDNS returns the OPT record answering the client's opt, or nil when the
+// client didn't use EDNS.
+func (s *Server) replyEDNS(opt *message.EDNS, rcode uint8) *message.EDNS {
+	if opt == nil {
+		return nil
+	}
+
+	return &message.EDNS{
+		UDPSize:  uint16(s.ednsSize),
+		ExtRcode: rcode >> 4,
+		DO:       opt.DO,
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+func TestErrorResponses(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+
+	notImp := buildQuery(0x0102, "example.com", 1)
+	binary.BigEndian.PutUint16(notImp[2:4], 2<<message.OPcodeBit) // STATUS
+
+	truncated := buildQuery(0x0304, "example.com", 1)
+	truncated = truncated[:len(truncated)-2]
+
+	tests := []struct {
+		name  string
+		query []byte
+		rcode uint8
+	}{
+		{"unsupported opcode", notImp, message.RcodeNotImplemented},
+		{"truncated question", truncated, message.RcodeFormatError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := srv.handleQuery(context.Background(), tt.query, "127.0.0.1")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			resp := srv.errorResponse(tt.query, err)
+			if resp == nil {
+				t.Fatal("no response")
+			}
+			if resp.Header.ID != binary.BigEndian.Uint16(tt.query[0:2]) {
+				t.Errorf("ID is not echoed")
+			}
+			if rcode := resp.Rcode(); rcode != tt.rcode {
+				t.Errorf("RCODE expected %d, got %d", tt.rcode, rcode)
+			}
+		})
+	}
+}
+
+func TestRateLimitedQueryIsRefused(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit = 0
+	srv := startTestServer(t, cfg)
+
+	query := buildQuery(0x0506, "example.com", 1)
+	_, err := srv.handleQuery(context.Background(), query, "10.0.0.1")
+	if message.Rcode(err) != message.RcodeRefused {
+		t.Errorf("expected REFUSED for a rate limited client, got %v", err)
+	}
+}
+
+func TestCachedRRsetFullyAnswered(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	srv.cache.Set(cache.NewKey("multi.example", 1, 1), [][]byte{{10, 0, 0, 1}, {10, 0, 0, 2}, {10, 0, 0, 3}}, 300)
+
+	sec, err := srv.handleQuery(context.Background(), buildQuery(0x3333, "MULTI.example", 1), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("handleQuery: %v", err)
+	}
+
+	if len(sec.Answer) != 3 {
+		t.Fatalf("expected every address of the RRset, got %d", len(sec.Answer))
+	}
+	for i, rr := range sec.Answer {
+		if rr.Data[3] != byte(i+1) {
+			t.Errorf("answer %d: unexpected address %v", i, rr.Data)
+		}
+	}
+}
+
+func TestCachedCNAMEChainReplayed(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	srv.cache.Set(cache.NewKey("www.alias.test", uint16(message.CNAME), 1), [][]byte{{6, 'c', 'a', 'n', 'o', 'n', 'i', 4, 't', 'e', 's', 't', 0}}, 300)
+	srv.cache.Set(cache.NewKey("canoni.test", 1, 1), [][]byte{{10, 9, 8, 7}}, 300)
+
+	sec, err := srv.handleQuery(context.Background(), buildQuery(0x4444, "www.alias.test", 1), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("handleQuery: %v", err)
+	}
+
+	if len(sec.Answer) != 2 {
+		t.Fatalf("expected the CNAME and the address, got %+v", sec.Answer)
+	}
+	if target, _ := sec.Answer[0].Target(); sec.Answer[0].Type != message.CNAME || target != "canoni.test" {
+		t.Errorf("first answer must be the CNAME, got %+v", sec.Answer[0])
+	}
+	if sec.Answer[1].Name != "canoni.test" || sec.Answer[1].Type != message.A {
+		t.Errorf("second answer must be the address of the target, got %+v", sec.Answer[1])
+	}
+}
+
+func TestCachedUnknownTypeServedOpaquely(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	rdata := []byte{0xDE, 0xAD, 0xBE, 0xEF, 0x00}
+	srv.cache.Set(cache.NewKey("opaque.test", 65280, 1), [][]byte{rdata}, 300)
+
+	sec, err := srv.handleQuery(context.Background(), buildQuery(0x5555, "opaque.test", 65280), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("handleQuery: %v", err)
+	}
+
+	if len(sec.Answer) != 1 || !bytes.Equal(sec.Answer[0].Data, rdata) {
+		t.Errorf("RDATA of the unknown type changed: %+v", sec.Answer)
+	}
+}
+
+func TestCachedDenialServedWithSOA(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	soa := append([]byte{2, 'n', 's', 4, 't', 'e', 's', 't', 0, 5, 'a', 'd', 'm', 'i', 'n', 4, 't', 'e', 's', 't', 0}, make([]byte, 20)...)
+	srv.cache.SetNegative(cache.NXDomainKey("missing.test", 1), message.RcodeNameError, "test", soa, 300)
+	srv.cache.SetNegative(cache.NewKey("v4only.test", uint16(message.AAAA), 1), message.RcodeSuccess, "test", soa, 300)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode uint8
+	}{
+		{"missing.test", uint16(message.AAAA), message.RcodeNameError},
+		{"v4only.test", uint16(message.AAAA), message.RcodeSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sec, err := srv.handleQuery(context.Background(), buildQuery(0x6666, tt.name, tt.qtype), "127.0.0.1")
+			if err != nil {
+				t.Fatalf("handleQuery: %v", err)
+			}
+
+			if rcode := sec.Rcode(); rcode != tt.rcode {
+				t.Errorf("expected rcode %d, got %d", tt.rcode, rcode)
+			}
+			if len(sec.Answer) != 0 {
+				t.Errorf("denial must have no answers, got %+v", sec.Answer)
+			}
+			if len(sec.Authority) != 1 || sec.Authority[0].Type != message.SOA || sec.Authority[0].Name != "test" || !bytes.Equal(sec.Authority[0].Data, soa) {
+				t.Errorf("expected the SOA of test in the authority section, got %+v", sec.Authority)
+			}
+		})
+	}
+}
+
+func TestCachedAnswerReportsRemainingTTL(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxTTL = time.Minute
+	srv := startTestServer(t, cfg)
+	srv.cache.Set(cache.NewKey("ttl.test", 1, 1), [][]byte{{10, 0, 0, 1}}, 3600)
+
+	sec, err := srv.handleQuery(context.Background(), buildQuery(0x9999, "ttl.test", 1), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("handleQuery: %v", err)
+	}
+
+	// TTL обрезан до max_ttl и отсчитывается от момента кэширования
+	if len(sec.Answer) != 1 || sec.Answer[0].TTL > 60 || sec.Answer[0].TTL < 59 {
+		t.Errorf("expected about 60 seconds left, got %+v", sec.Answer)
+	}
+}
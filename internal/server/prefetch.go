@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// prefetch refreshes the popular cache entries that are about to expire, one
+// at a time, until the server is closed. The number of goroutines running it
+// bounds the refreshes in flight.
+func (s *Server) prefetch(keys <-chan cache.Key) {
+	for {
+		select {
+		case key := <-keys:
+			s.refresh(key)
+		case <-s.exitCh:
+			return
+		}
+	}
+}
+
+// refresh resolves key again through the receiver its name is routed to,
+// which caches the new answer.
+func (s *Server) refresh(key cache.Key) {
+	defer s.cache.PrefetchDone(key)
+
+	route := s.route(key.Name)
+	if route.noCache || s.offline {
+		return
+	}
+
+	query, err := message.BuildQuery(message.Question{Name: key.Name, Type: message.QType(key.Type), Class: message.QClass(key.Class)})
+	if err != nil {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Refresh of %s type %d failed: %v", key.Name, key.Type, err)})
+		return
+	}
+
+	if _, err := route.rcv.RequestToGoogleDNS(context.Background(), query); err != nil {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Refresh of %s type %d failed: %v", key.Name, key.Type, err)})
+	}
+}
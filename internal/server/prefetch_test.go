@@ -0,0 +1,24 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+)
+
+func TestRefreshCachesNewAnswer(t *testing.T) {
+	cfg := testConfig()
+	cfg.Upstreams = startAnsweringUpstream(t, net.IPv4(10, 0, 0, 5))
+	srv := startTestServer(t, cfg)
+
+	key := cache.NewKey("hot.test", 1, 1)
+	srv.cache.Set(key, [][]byte{{10, 0, 0, 4}}, 1)
+	srv.refresh(key)
+
+	rrset, ok := srv.cache.Get(key)
+	if !ok || !bytes.Equal(rrset.Records[0], net.IPv4(10, 0, 0, 5).To4()) {
+		t.Errorf("prefetch didn't replace the entry: %+v", rrset)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+	"github.com/quic-go/quic-go"
+)
+
+// quicMaxStreams limits the queries a client may have in flight on one
+// connection.
+const quicMaxStreams = 100
+
+// DoQ error codes (RFC 9250 4.3)
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.StreamErrorCode      = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// StartQUIC serves DNS-over-QUIC (RFC 9250). Every bidirectional stream
+// carries exactly one length-prefixed query and its answer.
+func (s *Server) StartQUIC() error {
+	tlsConfig, err := s.loadTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.NextProtos = []string{"doq"}
+
+	udp, err := net.ListenUDP("udp", s.quicAddr)
+	if err != nil {
+		return err
+	}
+
+	ln, err := quic.Listen(udp, tlsConfig, &quic.Config{
+		MaxIdleTimeout:     s.tlsIdleTimeout,
+		MaxIncomingStreams: quicMaxStreams,
+	})
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	s.quicListener = ln
+	s.quicUDPConn = udp
+
+	go s.acceptQUIC()
+
+	return nil
+}
+
+func (s *Server) acceptQUIC() {
+	for {
+		conn, err := s.quicListener.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-s.exitCh:
+			default:
+				s.logger.Log(logger.LogEntry{Info: err.Error()})
+			}
+			return
+		}
+
+		if !s.trackQUICConn(conn) {
+			conn.CloseWithError(doqNoError, "server is shutting down")
+			return
+		}
+
+		go s.serveQUICConn(conn)
+	}
+}
+
+func (s *Server) serveQUICConn(conn *quic.Conn) {
+	defer func() {
+		s.untrackQUICConn(conn)
+		s.wg.Done()
+	}()
+
+	ip := conn.RemoteAddr().String()
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		ip = addr.IP.String()
+	}
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go s.serveQUICStream(conn, stream, ip)
+	}
+}
+
+func (s *Server) serveQUICStream(conn *quic.Conn, stream *quic.Stream, ip string) {
+	defer func() {
+		s.wg.Done()
+		if r := recover(); r != nil {
+			stream.CancelWrite(doqInternalError)
+			s.logger.Log(logger.LogEntry{
+				Info: fmt.Sprintf("panic recovered: %v", r),
+			})
+		}
+	}()
+
+	stream.SetDeadline(time.Now().Add(s.tlsIdleTimeout))
+
+	query, err := message.ReadFramed(stream)
+	if err != nil {
+		stream.CancelRead(doqInternalError)
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+
+	// DoQ clients must send ID 0, anything else is a protocol error
+	if len(query) >= 2 && binary.BigEndian.Uint16(query[0:2]) != 0 {
+		conn.CloseWithError(doqProtocolError, "message ID must be 0")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(conn.Context(), time.Second*30)
+	defer cancel()
+
+	response, err := s.handleQuery(ctx, query, ip)
+	if err != nil {
+		response = s.errorResponse(query, err)
+	}
+	var out []byte
+	if response != nil {
+		out = s.packReply(query, response, message.MaxTCPMsgSize)
+	}
+	if out == nil {
+		conn.CloseWithError(doqProtocolError, "malformed DNS message")
+		return
+	}
+
+	if err := message.WriteFramed(stream, out); err != nil {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("QUIC write to %s: %v", ip, err)})
+		return
+	}
+
+	// closing the send side delivers the FIN that ends the exchange
+	if err := stream.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("QUIC stream close: %v", err)})
+	}
+}
+
+// trackQUICConn works like trackTCPConn for QUIC connections.
+func (s *Server) trackQUICConn(conn *quic.Conn) bool {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	if s.quicConns == nil {
+		return false
+	}
+	s.quicConns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrackQUICConn(conn *quic.Conn) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	delete(s.quicConns, conn)
+}
+
+func (s *Server) closeQUICConns() {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	for conn := range s.quicConns {
+		conn.CloseWithError(doqNoError, "server is shutting down")
+	}
+	s.quicConns = nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+	"github.com/quic-go/quic-go"
+)
+
+func dialQUICServer(t *testing.T) *quic.Conn {
+	t.Helper()
+
+	ca := newTestCA(t)
+	cfg := testConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = ca.issue(t, x509.ExtKeyUsageServerAuth)
+
+	srv := startTestServer(t, cfg)
+	if err := srv.StartQUIC(); err != nil {
+		t.Fatalf("StartQUIC: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, srv.quicUDPConn.LocalAddr().String(), &tls.Config{
+		RootCAs:    ca.pool,
+		ServerName: "localhost",
+		NextProtos: []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+
+	return conn
+}
+
+func exchangeQUIC(conn *quic.Conn, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if err := message.WriteFramed(stream, query); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	return message.ReadFramed(stream)
+}
+
+func TestQUICQuery(t *testing.T) {
+	conn := dialQUICServer(t)
+
+	if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != "doq" {
+		t.Errorf("expected ALPN doq, got %q", proto)
+	}
+
+	// Каждый запрос идет в отдельном потоке
+	for range 3 {
+		resp, err := exchangeQUIC(conn, buildQuery(0, "example.com", 1))
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+
+		var msg message.Msg
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		if msg.Header.ID != 0 || len(msg.Answer) != 1 {
+			t.Errorf("unexpected answer header: %+v", msg.Header)
+		}
+	}
+}
+
+func TestQUICNonZeroID(t *testing.T) {
+	conn := dialQUICServer(t)
+
+	if _, err := exchangeQUIC(conn, buildQuery(0x1234, "example.com", 1)); err == nil {
+		t.Fatal("query with non-zero ID was answered")
+	}
+
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed after a protocol error")
+	}
+}
@@ -1,42 +1,188 @@
 package server
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/config"
 	"github.com/Vladroon22/DNS-Server/internal/logger"
 	"github.com/Vladroon22/DNS-Server/internal/message"
 	"github.com/Vladroon22/DNS-Server/internal/rate_limiter"
+	"github.com/Vladroon22/DNS-Server/internal/recursor"
+	"github.com/Vladroon22/DNS-Server/internal/suffix"
 	"github.com/Vladroon22/DNS-Server/internal/to_google"
+	"github.com/Vladroon22/DNS-Server/internal/upstream"
+	"github.com/quic-go/quic-go"
 )
 
 type Server struct {
-	cache         *cache.Cache
-	bufSize       int
-	isEnabledEDNS bool
-	udpConn       *net.UDPConn
-	udpAddr       *net.UDPAddr
-	limit         *rate_limiter.Limiter
-	logger        *logger.Logger
-	exitCh        chan struct{}
-	wg            *sync.WaitGroup
+	cache           *cache.Cache
+	bufSize         int
+	ednsSize        int
+	udpConn         *net.UDPConn
+	udpAddr         *net.UDPAddr
+	tcpListener     *net.TCPListener
+	tcpAddr         *net.TCPAddr
+	tcpIdleTimeout  time.Duration
+	tcpMaxQueries   int
+	tlsListener     net.Listener
+	tlsAddr         *net.TCPAddr
+	tlsIdleTimeout  time.Duration
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	httpServer      *http.Server
+	dohListener     net.Listener
+	dohAddr         *net.TCPAddr
+	dohPath         string
+	quicListener    *quic.Listener
+	quicUDPConn     *net.UDPConn
+	quicAddr        *net.UDPAddr
+	quicConns       map[*quic.Conn]struct{}
+	tcpConns        map[net.Conn]struct{}
+	connMtx         sync.Mutex
+	upstream        *to_google.DNSReceiver
+	pool            *upstream.Pool
+	routes          *suffix.Table[route]
+	forwardPools    []*upstream.Pool
+	forwardRcvs     []*to_google.DNSReceiver
+	staleWindow     time.Duration
+	staleTimeout    time.Duration
+	offline         bool
+	snapshotFile    string
+	limit           *rate_limiter.Limiter
+	logger          *logger.Logger
+	exitCh          chan struct{}
+	closeOnce       sync.Once
+	wg              *sync.WaitGroup
 }
 
-func DNSServer(udp *net.UDPAddr, rate int, lg *logger.Logger) *Server {
-	return &Server{
-		cache:         cache.InitCache(),
-		udpAddr:       udp,
-		limit:         rate_limiter.NewLimiter(rate),
-		isEnabledEDNS: false,
-		logger:        lg,
-		exitCh:        make(chan struct{}, 1),
-		wg:            &sync.WaitGroup{},
+func DNSServer(cfg *config.Config, lg *logger.Logger) (*Server, error) {
+	ednsSize := min(max(cfg.EDNSUDPSize, message.MinUDPSize), message.MaxTCPMsgSize)
+
+	strategy, err := upstream.ParseStrategy(cfg.UpstreamStrategy)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := cache.ParsePolicy(cfg.CachePolicy)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := cache.ParseTTLOverrides(cfg.TTLOverrides)
+	if err != nil {
+		return nil, err
+	}
+
+	che := cache.New(cache.Options{
+		NegativeTTLMax: cfg.NegativeTTLMax,
+		MaxEntries:     cfg.CacheMaxEntries,
+		MaxBytes:       int64(cfg.CacheMaxBytes),
+		Policy:         policy,
+		StaleWindow:    cfg.StaleWindow,
+		PrefetchHits:   cfg.PrefetchHits,
+		Shards:         cfg.CacheShards,
+		MinTTL:         cfg.MinTTL,
+		MaxTTL:         cfg.MaxTTL,
+		TTLOverrides:   overrides,
+	})
+
+	s := &Server{
+		cache:           che,
+		udpAddr:         &net.UDPAddr{IP: net.ParseIP(cfg.ListenHost), Port: cfg.UDPPort},
+		tcpAddr:         &net.TCPAddr{IP: net.ParseIP(cfg.ListenHost), Port: cfg.TCPPort},
+		tcpIdleTimeout:  cfg.TCPIdleTimeout,
+		tcpMaxQueries:   cfg.TCPMaxQueries,
+		tlsAddr:         &net.TCPAddr{IP: net.ParseIP(cfg.ListenHost), Port: cfg.TLSPort},
+		tlsIdleTimeout:  cfg.TLSIdleTimeout,
+		tlsCertFile:     cfg.TLSCertFile,
+		tlsKeyFile:      cfg.TLSKeyFile,
+		tlsClientCAFile: cfg.TLSClientCAFile,
+		dohAddr:         &net.TCPAddr{IP: net.ParseIP(cfg.ListenHost), Port: cfg.DoHPort},
+		dohPath:         cfg.DoHPath,
+		quicAddr:        &net.UDPAddr{IP: net.ParseIP(cfg.ListenHost), Port: cfg.QUICPort},
+		quicConns:       make(map[*quic.Conn]struct{}),
+		tcpConns:        make(map[net.Conn]struct{}),
+		limit:           rate_limiter.NewLimiter(cfg.RateLimit),
+		ednsSize:        ednsSize,
+		staleWindow:     cfg.StaleWindow,
+		staleTimeout:    cfg.StaleAnswerTimeout,
+		offline:         cfg.Offline,
+		snapshotFile:    cfg.CacheSnapshotFile,
+		logger:          lg,
+		exitCh:          make(chan struct{}, 1),
+		wg:              &sync.WaitGroup{},
+	}
+	s.bufSize = s.ednsSize
+
+	poolCfg := upstream.PoolConfig{
+		Strategy:      strategy,
+		Timeout:       cfg.UpstreamTimeout,
+		FailThreshold: cfg.UpstreamFailThreshold,
+		Cooldown:      cfg.UpstreamCooldown,
+		ProbeInterval: cfg.UpstreamProbeInterval,
+		Parallel:      cfg.UpstreamParallel,
+		HedgeDelay:    cfg.UpstreamHedgeDelay,
+	}
+	if err := s.setupResolution(cfg, poolCfg); err != nil {
+		s.closePools()
+		s.cache.Close()
+		return nil, err
+	}
+	go s.limit.StartLimiter()
+
+	if keys := che.Prefetches(); keys != nil {
+		for range max(cfg.PrefetchWorkers, 1) {
+			go s.prefetch(keys)
+		}
+	}
+
+	if s.snapshotFile != "" {
+		s.loadSnapshot()
+		if cfg.CacheSnapshotInterval > 0 {
+			go s.saveSnapshots(cfg.CacheSnapshotInterval)
+		}
+	}
+	if cfg.Warmup != "" {
+		go s.warmUp(strings.Split(cfg.Warmup, ","))
 	}
+
+	return s, nil
+}
+
+// setupResolution picks what answers cache misses: the iterative resolver or
+// the pool of upstreams, with the forwarding rules in front of either.
+func (s *Server) setupResolution(cfg *config.Config, poolCfg upstream.PoolConfig) error {
+	if cfg.Recursive {
+		hints := cfg.RootHints
+		if hints == "" {
+			hints = recursor.DefaultRootHints
+		}
+
+		resolver, err := recursor.New(recursor.Config{
+			RootHints: strings.Split(hints, ","),
+			Timeout:   cfg.UpstreamTimeout,
+		})
+		if err != nil {
+			return err
+		}
+		s.upstream = to_google.NewDNSReceiver(s.cache, resolver, s.ednsSize, s.logger)
+	} else {
+		upstreams, err := upstream.ParseList(cfg.Upstreams, s.ednsSize)
+		if err != nil {
+			return err
+		}
+		s.pool = upstream.NewPool(upstreams, poolCfg)
+		s.upstream = to_google.NewDNSReceiver(s.cache, s.pool, s.ednsSize, s.logger)
+	}
+
+	return s.loadRoutes(cfg, poolCfg)
 }
 
 func (s *Server) StartUDP() error {
@@ -46,13 +192,6 @@ func (s *Server) StartUDP() error {
 	}
 	s.udpConn = udp
 
-	if s.isEnabledEDNS {
-		s.bufSize = 4096
-	} else {
-		s.bufSize = 512
-	}
-
-	go s.limit.StartLimiter()
 	go s.acceptUDP()
 
 	return nil
@@ -67,8 +206,6 @@ func (s *Server) sendToClient(resp []byte, remote *net.UDPAddr) error {
 }
 
 func (s *Server) acceptUDP() {
-	GoogleDNS := to_google.NewDNSReceiver(s.cache, s.bufSize, s.isEnabledEDNS, s.logger)
-
 	bufPool := &sync.Pool{
 		New: func() interface{} {
 			return make([]byte, s.bufSize)
@@ -103,133 +240,28 @@ func (s *Server) acceptUDP() {
 			case <-s.exitCh:
 				return
 			case <-ctx.Done():
-				if err := s.sendToClient([]byte("Request denied due server's issues"), remote); err != nil {
-					s.logger.Log(logger.LogEntry{Info: err.Error()})
+				response := s.errorResponse(buffer[:n], ctx.Err())
+				if response == nil {
 					return
 				}
-				s.logger.Log(logger.LogEntry{Info: err.Error()})
-				return
-			default:
-
-				if isBanned, reason := s.limit.ProcessIP(string(remote.IP)); isBanned {
-					if err := s.sendToClient([]byte(reason), remote); err != nil {
-						s.logger.Log(logger.LogEntry{Info: err.Error()})
-						return
-					}
+				if err := s.sendToClient(s.fitUDP(buffer[:n], response), remote); err != nil {
 					s.logger.Log(logger.LogEntry{Info: err.Error()})
-					return
 				}
-
-				var response bytes.Buffer
-				header, err := message.HandleHeader(buffer[:12])
+				return
+			default:
+				response, err := s.handleQuery(ctx, buffer[:n], remote.IP.String())
 				if err != nil {
-					if err := s.sendToClient([]byte(err.Error()), remote); err != nil {
-						s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						return
-					}
-					s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-					return
+					response = s.errorResponse(buffer[:n], err)
 				}
-
-				s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Request header: %v", header)})
-				s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("questions: %d", header.Qdcount)})
-
-				questions, n, err := message.HandleQuestions(buffer[:b], header.Qdcount, s.cache)
-				if err != nil {
-					if err := s.sendToClient([]byte(err.Error()), remote); err != nil {
-						return
-					}
-					s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
+				if response == nil {
 					return
 				}
-
-				builder := message.NewResponseBuilder()
-
-				switch n {
-				case 0:
-					GoogleAnswer, err := GoogleDNS.RequestToGoogleDNS(c, buffer)
-					if err != nil {
-						if err := s.sendToClient([]byte(err.Error()), remote); err != nil {
-							s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						}
-						s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						return
-					}
-
-					if _, err := response.Write(GoogleAnswer); err != nil {
-						if err := s.sendToClient([]byte(err.Error()), remote); err != nil {
-							s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						}
-						s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						return
-					}
-
-					s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Google: %v", GoogleAnswer)})
-				case 1:
-					s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Cache questions: %v", questions[0])})
-
-					header.Ancount = 1
-					header.Qdcount = 1
-					header.Arcount = 0
-					header.Nscount = 0
-
-					header.SetFlags(1, 0, 0, 0, 0, 1, 0, 0)
-					resp := builder.BuildResponse(header, questions[0], s.cache)
-					if resp.Err != nil {
-						if err := s.sendToClient([]byte(resp.Err.Error()), remote); err != nil {
-							s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						}
-						s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: response builder error: %s", err)})
-						return
-					}
-
-					if _, err := response.Write(resp.Data); err != nil {
-						if err := s.sendToClient([]byte(err.Error()), remote); err != nil {
-							s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						}
-						s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-						return
-					}
-
-				default:
-					for _, que := range questions {
-						s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Cache question: %v", que)})
-					}
-
-					header.SetFlags(1, 0, 0, 0, 1, 1, 0, 0)
-					header.Qdcount = uint16(n)
-
-					wg := &sync.WaitGroup{}
-					respChan := make(chan message.Response, n)
-					for _, que := range questions {
-						wg.Add(1)
-						go func(que message.Question) {
-							defer wg.Done()
-							respChan <- builder.BuildResponse(header, que, s.cache)
-						}(que)
-					}
-
-					go func() {
-						close(respChan)
-						wg.Wait()
-					}()
-
-					for resp := range respChan {
-						if resp.Err != nil {
-							if err := s.sendToClient([]byte(resp.Err.Error()), remote); err != nil {
-								s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
-							}
-							s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Builder response: %v", err)})
-							continue
-						}
-
-						if _, err := response.Write(resp.Data); err != nil {
-							s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("response error: %s", err.Error())})
-						}
-					}
+				out := s.fitUDP(buffer[:n], response)
+				if out == nil {
+					return
 				}
 
-				if err := s.sendToClient(response.Bytes(), remote); err != nil {
+				if err := s.sendToClient(out, remote); err != nil {
 					s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Error: %v", err)})
 					return
 				}
@@ -240,12 +272,53 @@ func (s *Server) acceptUDP() {
 	}
 }
 
-func (s *Server) CloseUDP() error {
+// Close stops every listener, waits for in-flight queries and releases the
+// cache and rate limiter. Calls after the first one are no-ops.
+func (s *Server) Close() error {
+	err := errors.New("server is already closed")
+	s.closeOnce.Do(func() {
+		err = s.shutdown()
+	})
+	return err
+}
+
+func (s *Server) shutdown() error {
 	close(s.exitCh)
 
-	if err := s.udpConn.Close(); err != nil {
-		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("%v", err)})
+	if s.udpConn != nil {
+		if err := s.udpConn.Close(); err != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("%v", err)})
+		}
+	}
+
+	if s.tcpListener != nil {
+		if err := s.tcpListener.Close(); err != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("%v", err)})
+		}
+	}
+
+	if s.tlsListener != nil {
+		if err := s.tlsListener.Close(); err != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("%v", err)})
+		}
+	}
+
+	if s.httpServer != nil {
+		if err := s.httpServer.Close(); err != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("%v", err)})
+		}
+	}
+
+	if s.quicListener != nil {
+		if err := s.quicListener.Close(); err != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("%v", err)})
+		}
 	}
+	s.closeQUICConns()
+	if s.quicUDPConn != nil {
+		s.quicUDPConn.Close()
+	}
+	s.closeTCPConns()
 
 	done := make(chan struct{})
 	go func() {
@@ -256,15 +329,28 @@ func (s *Server) CloseUDP() error {
 	select {
 	case <-time.After(15 * time.Second):
 		return fmt.Errorf("shutdown timeout")
-	default:
+	case <-done:
 		if s.limit != nil {
 			s.limit.Close()
 		}
 
+		s.logStats()
+		s.closePools()
+
 		if s.cache != nil {
+			s.saveSnapshot()
 			s.cache.Close()
 		}
 	}
 
 	return nil
 }
+
+func (s *Server) closePools() {
+	if s.pool != nil {
+		s.pool.Close()
+	}
+	for _, pool := range s.forwardPools {
+		pool.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// loadSnapshot fills the cache from the snapshot file. A missing or
+// unreadable snapshot only means a cold start.
+func (s *Server) loadSnapshot() {
+	n, err := s.cache.LoadFile(s.snapshotFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Cache snapshot %s not loaded: %v", s.snapshotFile, err)})
+	default:
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Loaded %d cache entries from %s", n, s.snapshotFile)})
+	}
+}
+
+func (s *Server) saveSnapshot() {
+	if s.snapshotFile == "" {
+		return
+	}
+
+	if err := s.cache.SaveFile(s.snapshotFile); err != nil {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Cache snapshot %s not saved: %v", s.snapshotFile, err)})
+	}
+}
+
+func (s *Server) saveSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.saveSnapshot()
+		case <-s.exitCh:
+			return
+		}
+	}
+}
+
+// warmUp resolves the A and AAAA records of names, skipping what the
+// snapshot already brought back.
+func (s *Server) warmUp(names []string) {
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		for _, qtype := range []message.QType{message.A, message.AAAA} {
+			select {
+			case <-s.exitCh:
+				return
+			default:
+			}
+
+			key := cache.NewKey(name, uint16(qtype), uint16(message.IN))
+			if _, ok := s.cache.Get(key); !ok {
+				s.refresh(key)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+)
+
+func TestCacheSurvivesRestart(t *testing.T) {
+	cfg := testConfig()
+	cfg.CacheSnapshotFile = filepath.Join(t.TempDir(), "cache.snapshot")
+
+	srv := startTestServer(t, cfg)
+	srv.cache.Set(cache.NewKey("kept.test", 1, 1), [][]byte{{10, 0, 0, 1}}, 300)
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restarted := startTestServer(t, cfg)
+	if _, ok := restarted.cache.Get(cache.NewKey("kept.test", 1, 1)); !ok {
+		t.Error("cache entry lost across the restart")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	cfg := testConfig()
+	cfg.Upstreams = startAnsweringUpstream(t, net.IPv4(10, 0, 0, 6))
+	cfg.Warmup = "api.test, www.test"
+
+	srv := startTestServer(t, cfg)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, name := range []string{"api.test", "www.test"} {
+		for {
+			if _, ok := srv.cache.Get(cache.NewKey(name, 1, 1)); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not resolved at startup", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// forward resolves query through the upstreams of route. When they fail, or
+// don't answer within staleTimeout, an expired answer still in the stale window
+// is served instead (RFC 8767). A timed out exchange keeps running and
+// refreshes the cache when it completes. In offline mode only the cache is
+// used.
+func (s *Server) forward(ctx context.Context, route route, q *message.Msg, query []byte, opt *message.EDNS) (*message.Msg, error) {
+	var stale *message.Msg
+	if !route.noCache {
+		stale = s.staleAnswer(q, opt)
+	}
+
+	if s.offline {
+		if stale == nil {
+			return nil, fmt.Errorf("%w: offline and the answer is not cached", message.ErrServerFailure)
+		}
+		return stale, nil
+	}
+	if stale == nil {
+		return s.exchange(ctx, route, query)
+	}
+
+	// the exchange outlives this context when it is the one refreshing the
+	// cache, giving up here only stops waiting for it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *message.Msg
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := s.exchange(ctx, route, query)
+		done <- result{resp: resp, err: err}
+	}()
+
+	// without a timeout the client waits for the upstreams to fail
+	var timeout <-chan time.Time
+	if s.staleTimeout > 0 {
+		timer := time.NewTimer(s.staleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-done:
+		if res.err == nil {
+			return res.resp, nil
+		}
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Serving stale answer, upstream failed: %v", res.err)})
+	case <-timeout:
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Serving stale answer, no upstream answer in %v", s.staleTimeout)})
+	}
+
+	return stale, nil
+}
+
+// staleAnswer builds the reply to q from the cache, expired records included,
+// or returns nil when it can't be answered that way.
+func (s *Server) staleAnswer(q *message.Msg, opt *message.EDNS) *message.Msg {
+	if s.staleWindow == 0 {
+		return nil
+	}
+
+	resp, err := s.cachedAnswer(q, opt, true)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// exchange sends query to the upstreams of route and decodes their answer.
+func (s *Server) exchange(ctx context.Context, route route, query []byte) (*message.Msg, error) {
+	data, err := route.rcv.RequestToGoogleDNS(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp message.Msg
+	if err := resp.Unpack(data); err != nil {
+		return nil, fmt.Errorf("%w: bad upstream answer: %v", message.ErrServerFailure, err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// startSilentUpstream reads queries over UDP and never answers them.
+func startSilentUpstream(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func TestServeStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream string
+	}{
+		{"upstream fails", "udp://127.0.0.1:9"},
+		{"upstream too slow", startSilentUpstream(t)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Upstreams = tt.upstream
+			cfg.UpstreamTimeout = 5 * time.Second
+			cfg.StaleWindow = time.Hour
+			cfg.StaleAnswerTimeout = 100 * time.Millisecond
+
+			srv := startTestServer(t, cfg)
+			// запись уже истекла, но ещё в окне устаревания
+			srv.cache.Set(cache.NewKey("stale.test", 1, 1), [][]byte{{10, 0, 0, 9}}, 0)
+
+			start := time.Now()
+			sec, err := srv.handleQuery(context.Background(), buildQuery(0x7777, "stale.test", 1), "127.0.0.1")
+			if err != nil {
+				t.Fatalf("handleQuery: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("stale answer took %v", elapsed)
+			}
+
+			if len(sec.Answer) != 1 || !net.IP(sec.Answer[0].Data).Equal(net.IPv4(10, 0, 0, 9)) {
+				t.Fatalf("expected the stale address, got %+v", sec.Answer)
+			}
+			if sec.Answer[0].TTL != message.StaleTTL {
+				t.Errorf("stale TTL %d, expected %d", sec.Answer[0].TTL, message.StaleTTL)
+			}
+		})
+	}
+}
+
+func TestNoStaleOutsideWindow(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	srv.cache.Set(cache.NewKey("stale.test", 1, 1), [][]byte{{10, 0, 0, 9}}, 0)
+
+	if _, err := srv.handleQuery(context.Background(), buildQuery(0x7777, "stale.test", 1), "127.0.0.1"); err == nil {
+		t.Error("expired answer served without a stale window")
+	}
+}
+
+func TestOfflineMode(t *testing.T) {
+	cfg := testConfig()
+	cfg.Upstreams = startAnsweringUpstream(t, net.IPv4(1, 2, 3, 4))
+	cfg.StaleWindow = time.Hour
+	cfg.Offline = true
+
+	srv := startTestServer(t, cfg)
+	srv.cache.Set(cache.NewKey("fresh.test", 1, 1), [][]byte{{10, 0, 0, 1}}, 300)
+	srv.cache.Set(cache.NewKey("stale.test", 1, 1), [][]byte{{10, 0, 0, 2}}, 0)
+
+	for _, name := range []string{"fresh.test", "stale.test"} {
+		resp, err := srv.handleQuery(context.Background(), buildQuery(0x8888, name, 1), "127.0.0.1")
+		if err != nil {
+			t.Fatalf("%s: handleQuery: %v", name, err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s not answered from the cache", name)
+		}
+	}
+
+	_, err := srv.handleQuery(context.Background(), buildQuery(0x8888, "missing.test", 1), "127.0.0.1")
+	if !errors.Is(err, message.ErrServerFailure) {
+		t.Errorf("expected SERVFAIL for an uncached name, got %v", err)
+	}
+	// ответ апстрима попал бы в кэш
+	if _, ok := srv.cache.Get(cache.NewKey("missing.test", 1, 1)); ok {
+		t.Error("offline server asked the upstream")
+	}
+}
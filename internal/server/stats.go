@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/to_google"
+	"github.com/Vladroon22/DNS-Server/internal/upstream"
+)
+
+// logStats writes the counters gathered while the server ran, it is called
+// on shutdown before the pools and the cache are released.
+func (s *Server) logStats() {
+	if s.pool != nil {
+		s.logPoolStats(s.pool)
+	}
+	for _, pool := range s.forwardPools {
+		s.logPoolStats(pool)
+	}
+
+	var total to_google.CoalesceStats
+	for _, rcv := range append([]*to_google.DNSReceiver{s.upstream}, s.forwardRcvs...) {
+		if rcv == nil {
+			continue
+		}
+		st := rcv.CoalesceStats()
+		total.InFlight += st.InFlight
+		total.Waiting += st.Waiting
+		total.Coalesced += st.Coalesced
+	}
+	s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Coalesced %d queries into exchanges already in flight, %d exchanges with %d waiters left",
+		total.Coalesced, total.InFlight, total.Waiting)})
+
+	if s.cache != nil {
+		st := s.cache.Stats()
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Cache: %d entries, %d bytes, %d evicted, %d rejected, %d expired",
+			st.Entries, st.Bytes, st.Evicted, st.Rejected, st.Expired)})
+		if s.cache.Prefetches() != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Prefetch: %d queued, %d dropped, %d failed, %d saved a miss",
+				st.Prefetches, st.PrefetchDropped, st.PrefetchFailed, st.PrefetchSaved)})
+		}
+	}
+}
+
+func (s *Server) logPoolStats(pool *upstream.Pool) {
+	for _, st := range pool.Stats() {
+		s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("Upstream %s: %d requests, %d errors, %d timeouts, %d wins, latency %v, circuit %s",
+			st.Address, st.Requests, st.Errors, st.Timeouts, st.Wins, st.Latency, st.State)})
+	}
+}
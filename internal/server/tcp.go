@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+func (s *Server) StartTCP() error {
+	tcp, err := net.ListenTCP("tcp", s.tcpAddr)
+	if err != nil {
+		return err
+	}
+	s.tcpListener = tcp
+
+	go s.acceptStream(tcp, s.tcpIdleTimeout)
+
+	return nil
+}
+
+// maxAcceptDelay caps the pause after a failed Accept, e.g. when the process
+// runs out of file descriptors.
+const maxAcceptDelay = time.Second
+
+// acceptStream serves every connection accepted by ln as a stream of
+// length-prefixed queries. It's shared by the TCP and TLS listeners. Only a
+// closed listener stops it, other Accept errors are retried after a pause.
+func (s *Server) acceptStream(ln net.Listener, idle time.Duration) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("accept: %v, retrying in %v", err, delay)})
+			select {
+			case <-s.exitCh:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+
+		if !s.trackTCPConn(conn) {
+			conn.Close()
+			return
+		}
+
+		go s.serveStream(conn, idle)
+	}
+}
+
+// serveStream answers length-prefixed queries on conn until the client goes
+// idle, hits the per-connection query limit or the server shuts down.
+func (s *Server) serveStream(conn net.Conn, idle time.Duration) {
+	defer func() {
+		s.untrackTCPConn(conn)
+		conn.Close()
+		s.wg.Done()
+		if r := recover(); r != nil {
+			s.logger.Log(logger.LogEntry{
+				Info: fmt.Sprintf("panic recovered: %v", r),
+			})
+		}
+	}()
+
+	ip := conn.RemoteAddr().String()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+
+	for served := 0; s.tcpMaxQueries <= 0 || served < s.tcpMaxQueries; served++ {
+		if err := conn.SetReadDeadline(time.Now().Add(idle)); err != nil {
+			s.logger.Log(logger.LogEntry{Info: err.Error()})
+			return
+		}
+
+		query, err := message.ReadFramed(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("stream read from %s: %v", ip, err)})
+			}
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		response, err := s.handleQuery(ctx, query, ip)
+		cancel()
+		if err != nil {
+			response = s.errorResponse(query, err)
+		}
+		if response == nil {
+			return
+		}
+		out := s.packReply(query, response, message.MaxTCPMsgSize)
+		if out == nil {
+			return
+		}
+
+		if err := conn.SetWriteDeadline(time.Now().Add(idle)); err != nil {
+			s.logger.Log(logger.LogEntry{Info: err.Error()})
+			return
+		}
+
+		if err := message.WriteFramed(conn, out); err != nil {
+			s.logger.Log(logger.LogEntry{Info: fmt.Sprintf("stream write to %s: %v", ip, err)})
+			return
+		}
+	}
+}
+
+// trackTCPConn registers conn so Close can interrupt its blocking read. It
+// reports false once the server is shutting down.
+func (s *Server) trackTCPConn(conn net.Conn) bool {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	if s.tcpConns == nil {
+		return false
+	}
+	s.tcpConns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrackTCPConn(conn net.Conn) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	delete(s.tcpConns, conn)
+}
+
+func (s *Server) closeTCPConns() {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	for conn := range s.tcpConns {
+		conn.Close()
+	}
+	s.tcpConns = nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/config"
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+func buildQuery(id uint16, name string, qtype uint16) []byte {
+	query := make([]byte, 12)
+	binary.BigEndian.PutUint16(query[0:2], id)
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(query[4:6], 1)      // QDCOUNT
+
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	query = binary.BigEndian.AppendUint16(query, 1) // IN
+
+	return query
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		ListenHost:     "127.0.0.1",
+		RateLimit:      1000,
+		TCPIdleTimeout: time.Second,
+		TCPMaxQueries:  10,
+		EDNSUDPSize:    1232,
+		TLSIdleTimeout: time.Second,
+		Upstreams:      "udp://127.0.0.1:9",
+	}
+}
+
+func startTestServer(t *testing.T, cfg *config.Config) *Server {
+	t.Helper()
+
+	lg := logger.NewLogger()
+	go lg.StartLogging()
+	t.Cleanup(lg.Stop)
+
+	srv, err := DNSServer(cfg, lg)
+	if err != nil {
+		t.Fatalf("DNSServer: %v", err)
+	}
+
+	if err := srv.StartTCP(); err != nil {
+		t.Fatalf("StartTCP: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	srv.cache.Set(cache.NewKey("example.com", 1, 1), [][]byte{net.IPv4(93, 184, 216, 34).To4()}, 300)
+	return srv
+}
+
+// flakyListener fails its first Accept calls the way a listener that ran out
+// of file descriptors does.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptSurvivesErrors(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	flaky := &flakyListener{Listener: ln}
+	flaky.failures.Store(3)
+	go srv.acceptStream(flaky, time.Second)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// после ошибок Accept сервер продолжает принимать соединения
+	if err := message.WriteFramed(conn, buildQuery(0xACCE, "example.com", 1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := message.ReadFramed(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	var msg message.Msg
+	if err := msg.Unpack(resp); err != nil || msg.Header.ID != 0xACCE {
+		t.Errorf("unexpected answer: %+v %v", msg.Header, err)
+	}
+}
+
+func TestTCPCachedAnswer(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+
+	conn, err := net.Dial("tcp", srv.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Несколько запросов подряд по одному соединению
+	for _, id := range []uint16{0xBEEF, 0xCAFE} {
+		if err := message.WriteFramed(conn, buildQuery(id, "example.com", 1)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := message.ReadFramed(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		var msg message.Msg
+		if err := msg.Unpack(resp); err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		header := msg.Header
+		if header.ID != id {
+			t.Errorf("ID mismatch: expected %04x, got %04x", id, header.ID)
+		}
+		if header.Flags>>message.QRBit != 1 {
+			t.Errorf("QR bit is not set: %04x", header.Flags)
+		}
+		if header.Ancount != 1 {
+			t.Errorf("ANCOUNT expected 1, got %d", header.Ancount)
+		}
+		if !bytes.HasSuffix(resp, []byte{93, 184, 216, 34}) {
+			t.Errorf("answer does not end with cached address: %v", resp)
+		}
+	}
+}
+
+func TestTCPMaxQueriesPerConn(t *testing.T) {
+	cfg := testConfig()
+	cfg.TCPMaxQueries = 1
+	srv := startTestServer(t, cfg)
+
+	conn, err := net.Dial("tcp", srv.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	message.WriteFramed(conn, buildQuery(1, "example.com", 1))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := message.ReadFramed(conn); err != nil {
+		t.Fatalf("first query failed: %v", err)
+	}
+
+	message.WriteFramed(conn, buildQuery(2, "example.com", 1))
+	if _, err := message.ReadFramed(conn); err == nil {
+		t.Error("expected connection to be closed after query limit")
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.TCPIdleTimeout = 100 * time.Millisecond
+	srv := startTestServer(t, cfg)
+
+	conn, err := net.Dial("tcp", srv.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("expected idle connection to be closed by server")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("server did not close idle connection")
+	}
+}
+
+func TestCloseInterruptsTCPConns(t *testing.T) {
+	cfg := testConfig()
+	cfg.TCPIdleTimeout = time.Minute
+	srv := startTestServer(t, cfg)
+
+	conn, err := net.Dial("tcp", srv.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on an open TCP connection")
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// StartTLS serves DNS-over-TLS (RFC 7858). Queries use the same two-byte
+// length framing as TCP.
+func (s *Server) StartTLS() error {
+	tlsConfig, err := s.loadTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.NextProtos = []string{"dot"}
+
+	tcp, err := net.ListenTCP("tcp", s.tlsAddr)
+	if err != nil {
+		return err
+	}
+	s.tlsListener = tls.NewListener(tcp, tlsConfig)
+
+	go s.acceptStream(s.tlsListener, s.tlsIdleTimeout)
+
+	return nil
+}
+
+// loadTLSConfig builds the server side TLS settings shared by DNS-over-TLS
+// and DNS-over-HTTPS.
+func (s *Server) loadTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS key pair: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// session tickets let clients resume without a full handshake, Go
+		// rotates the ticket keys on its own
+		SessionTicketsDisabled: false,
+	}
+
+	if s.tlsClientCAFile != "" {
+		pem, err := os.ReadFile(s.tlsClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+
+	return &testCA{cert: cert, key: key, pool: pool, file: file}
+}
+
+// issue signs a leaf certificate and returns the paths to its PEM files.
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func startTLSServer(t *testing.T, ca *testCA, requireClientCert bool) *Server {
+	t.Helper()
+
+	cfg := testConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = ca.issue(t, x509.ExtKeyUsageServerAuth)
+	if requireClientCert {
+		cfg.TLSClientCAFile = ca.file
+	}
+
+	srv := startTestServer(t, cfg)
+	if err := srv.StartTLS(); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+	return srv
+}
+
+func TestTLSQuery(t *testing.T) {
+	ca := newTestCA(t)
+	srv := startTLSServer(t, ca, false)
+
+	clientConfig := &tls.Config{
+		RootCAs:            ca.pool,
+		ServerName:         "localhost",
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+
+	// Второе соединение должно переиспользовать сессию
+	for i, resumed := range []bool{false, true} {
+		conn, err := tls.Dial("tcp", srv.tlsListener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+
+		if err := message.WriteFramed(conn, buildQuery(uint16(i), "example.com", 1)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := message.ReadFramed(conn)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var msg message.Msg
+		if err := msg.Unpack(resp); err != nil || len(msg.Answer) != 1 {
+			t.Errorf("unexpected answer: %+v %v", msg.Header, err)
+		}
+
+		state := conn.ConnectionState()
+		if state.Version != tls.VersionTLS13 {
+			t.Errorf("expected TLS 1.3, got %x", state.Version)
+		}
+		if state.DidResume != resumed {
+			t.Errorf("connection %d: DidResume = %v", i, state.DidResume)
+		}
+		conn.Close()
+	}
+}
+
+func TestTLSRejectsOldVersions(t *testing.T) {
+	ca := newTestCA(t)
+	srv := startTLSServer(t, ca, false)
+
+	conn, err := tls.Dial("tcp", srv.tlsListener.Addr().String(), &tls.Config{
+		RootCAs:    ca.pool,
+		ServerName: "localhost",
+		MaxVersion: tls.VersionTLS12,
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS 1.2 handshake succeeded")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	srv := startTLSServer(t, ca, true)
+	addr := srv.tlsListener.Addr().String()
+
+	exchange := func(cfg *tls.Config) error {
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if err := message.WriteFramed(conn, buildQuery(1, "example.com", 1)); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = message.ReadFramed(conn)
+		return err
+	}
+
+	// В TLS 1.3 ошибка сертификата клиента видна только при чтении
+	if err := exchange(&tls.Config{RootCAs: ca.pool, ServerName: "localhost"}); err == nil {
+		t.Error("query without a client certificate was answered")
+	}
+
+	certFile, keyFile := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load client certificate: %v", err)
+	}
+
+	if err := exchange(&tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Errorf("query with a client certificate failed: %v", err)
+	}
+}
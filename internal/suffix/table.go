@@ -0,0 +1,53 @@
+package suffix
+
+import "strings"
+
+// Table maps domain suffixes to values and finds the longest suffix of a
+// name. A lookup costs one map access per label of the name, however many
+// suffixes are registered.
+type Table[V any] struct {
+	suffixes map[string]V
+}
+
+func NewTable[V any]() *Table[V] {
+	return &Table[V]{suffixes: make(map[string]V)}
+}
+
+// Add registers v for suffix. A suffix that is already taken keeps its first
+// value and Add reports false. "." matches every name.
+func (t *Table[V]) Add(suffix string, v V) bool {
+	suffix = canonical(suffix)
+	if _, ok := t.suffixes[suffix]; ok {
+		return false
+	}
+	t.suffixes[suffix] = v
+	return true
+}
+
+// Lookup returns the value of the longest registered suffix of name.
+func (t *Table[V]) Lookup(name string) (V, string, bool) {
+	name = canonical(name)
+	for {
+		if v, ok := t.suffixes[name]; ok {
+			return v, name, true
+		}
+		if name == "" {
+			var zero V
+			return zero, "", false
+		}
+
+		if dot := strings.IndexByte(name, '.'); dot >= 0 {
+			name = name[dot+1:]
+		} else {
+			name = ""
+		}
+	}
+}
+
+func (t *Table[V]) Len() int {
+	return len(t.suffixes)
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
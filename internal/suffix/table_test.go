@@ -0,0 +1,57 @@
+package suffix
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLongestSuffix(t *testing.T) {
+	table := NewTable[string]()
+	table.Add("corp.example.", "corp")
+	table.Add("dev.corp.example", "dev")
+	table.Add("10.in-addr.arpa", "reverse")
+
+	if table.Add("CORP.example", "again") {
+		t.Error("duplicate suffix replaced the first rule")
+	}
+
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"corp.example", "corp", true},
+		{"www.Corp.Example.", "corp", true},
+		{"a.b.dev.corp.example", "dev", true},
+		{"notcorp.example", "", false},
+		{"4.3.2.10.in-addr.arpa", "reverse", true},
+		{"example", "", false},
+	}
+
+	for _, tt := range tests {
+		got, _, ok := table.Lookup(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Lookup(%q) = %q, %v; expected %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRootSuffixMatchesEverything(t *testing.T) {
+	table := NewTable[int]()
+	table.Add(".", 1)
+
+	if v, suffix, ok := table.Lookup("any.name"); !ok || v != 1 || suffix != "" {
+		t.Errorf("root rule didn't match: %d %q %v", v, suffix, ok)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	table := NewTable[int]()
+	for i := range 10000 {
+		table.Add(fmt.Sprintf("zone%d.corp.example", i), i)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		table.Lookup(fmt.Sprintf("host.zone%d.corp.example", i%20000))
+	}
+}
@@ -0,0 +1,114 @@
+package to_google
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// coalesceTimeout bounds an exchange that is shared by several clients, it
+// no longer follows the context of the client that started it.
+const coalesceTimeout = 30 * time.Second
+
+// call is an upstream exchange that identical queries wait on.
+type call struct {
+	done    chan struct{}
+	resp    *message.Msg
+	err     error
+	waiters int // guarded by DNSReceiver.inflightMtx
+}
+
+// CoalesceStats shows how many identical in-flight queries were collapsed
+// into one upstream exchange.
+type CoalesceStats struct {
+	InFlight  int    // upstream exchanges running now
+	Waiting   int    // queries waiting on an exchange another query started
+	Coalesced uint64 // queries answered by another query's exchange so far
+}
+
+func (rcv *DNSReceiver) CoalesceStats() CoalesceStats {
+	rcv.inflightMtx.Lock()
+	defer rcv.inflightMtx.Unlock()
+
+	stats := CoalesceStats{InFlight: len(rcv.inflight), Coalesced: rcv.coalesced.Load()}
+	for _, c := range rcv.inflight {
+		stats.Waiting += c.waiters
+	}
+	return stats
+}
+
+// coalesceKey identifies queries that can share an answer: the same name,
+// type and class, and the same DO bit. Queries without exactly one question
+// are never shared, the key only covers the first.
+func coalesceKey(request *message.Msg) (string, bool) {
+	if len(request.Question) != 1 {
+		return "", false
+	}
+	opt, err := request.EDNS()
+	if err != nil {
+		return "", false
+	}
+
+	que := request.Question[0]
+	return fmt.Sprintf("%s/%d/%d/%t", strings.ToLower(strings.TrimSuffix(que.Name, ".")), que.Type, que.Class, opt != nil && opt.DO), true
+}
+
+// coalesce runs exchange for request unless an identical query is already
+// being resolved, in which case it waits for that answer instead. Every
+// caller gets its own copy with its own ID and spelling of the name.
+func (rcv *DNSReceiver) coalesce(ctx context.Context, request *message.Msg, exchange func(context.Context, *message.Msg) (*message.Msg, error)) (*message.Msg, error) {
+	key, ok := coalesceKey(request)
+	if !ok {
+		return exchange(ctx, request)
+	}
+
+	rcv.inflightMtx.Lock()
+	c, shared := rcv.inflight[key]
+	if shared {
+		c.waiters++
+	} else {
+		c = &call{done: make(chan struct{})}
+		rcv.inflight[key] = c
+	}
+	rcv.inflightMtx.Unlock()
+
+	if !shared {
+		go func() {
+			// the exchange outlives a leader that gave up, others still wait on it
+			xctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), coalesceTimeout)
+			defer cancel()
+
+			c.resp, c.err = exchange(xctx, request)
+
+			rcv.inflightMtx.Lock()
+			delete(rcv.inflight, key)
+			rcv.inflightMtx.Unlock()
+			close(c.done)
+		}()
+	}
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		if shared {
+			rcv.inflightMtx.Lock()
+			c.waiters--
+			rcv.inflightMtx.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	if shared {
+		rcv.coalesced.Add(1)
+	}
+
+	resp := c.resp.Copy()
+	resp.RestoreQuery(request)
+	return resp, nil
+}
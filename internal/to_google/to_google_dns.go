@@ -2,176 +2,219 @@ package to_google
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"net"
+	"math/rand/v2"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Vladroon22/DNS-Server/internal/cache"
 	"github.com/Vladroon22/DNS-Server/internal/logger"
 	"github.com/Vladroon22/DNS-Server/internal/message"
+	"github.com/Vladroon22/DNS-Server/internal/upstream"
 )
 
-var (
-	DNSServers = []string{"1.1.1.1:53", "8.8.8.8:853", "8.8.4.4:53"}
-)
+// caseMissLimit is how many exchanges in a row may fail only on the case of
+// the question before the upstream is taken for one that doesn't echo it.
+const caseMissLimit = 3
 
 type DNSReceiver struct {
-	msgSize int
-	network string
-	eDNS    bool
-	che     *cache.Cache
-	lg      *logger.Logger
+	msgSize  int
+	upstream upstream.Upstream
+	che      *cache.Cache
+	lg       *logger.Logger
+	dropped  atomic.Uint64
+
+	caseMisses atomic.Int32
+	noCase     atomic.Bool // the upstream doesn't echo the case, 0x20 is off
+
+	inflightMtx sync.Mutex
+	inflight    map[string]*call
+	coalesced   atomic.Uint64
 }
 
-func NewDNSReceiver(che *cache.Cache, size int, eDNS bool, myLogger *logger.Logger) *DNSReceiver {
+// NewDNSReceiver creates a receiver that forwards queries to up. Queries
+// carrying an OPT record advertise size as their UDP payload size. With a nil
+// che answers are checked but not cached.
+func NewDNSReceiver(che *cache.Cache, up upstream.Upstream, size int, myLogger *logger.Logger) *DNSReceiver {
 	return &DNSReceiver{
-		eDNS:    eDNS,
-		msgSize: size,
-		che:     che,
-		lg:      myLogger,
+		msgSize:  max(size, message.MinUDPSize),
+		upstream: up,
+		che:      che,
+		lg:       myLogger,
+		inflight: make(map[string]*call),
 	}
 }
 
+// Dropped returns how many upstream answers were rejected because they
+// didn't match the forwarded query.
+func (rcv *DNSReceiver) Dropped() uint64 {
+	return rcv.dropped.Load()
+}
+
+// RequestToGoogleDNS resolves request through the upstream. Identical
+// queries that arrive while it is running share its answer.
 func (rcv *DNSReceiver) RequestToGoogleDNS(ctx context.Context, request []byte) ([]byte, error) {
-	if rcv.eDNS {
-		rcv.msgSize = 4096
-		rcv.network = "tcp"
-	} else {
-		rcv.msgSize = 512
-		rcv.network = "udp"
+	var query message.Msg
+	if err := query.Unpack(request); err != nil {
+		return nil, err
 	}
 
-	var conn net.Conn
-	for _, dns := range DNSServers {
-		var err error
-		conn, err = net.DialTimeout(rcv.network, dns, 5*time.Second)
-		if err == nil {
-			break
-		}
+	resp, err := rcv.coalesce(ctx, &query, rcv.exchange)
+	if err != nil {
+		return nil, err
 	}
-	defer conn.Close()
+	return resp.Pack()
+}
 
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
+func (rcv *DNSReceiver) exchange(ctx context.Context, query *message.Msg) (*message.Msg, error) {
+	resp, err := rcv.send(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Truncated() {
+		// don't cache a partial answer, the client will retry over TCP
+		return resp, nil
+	}
 
-	if _, err := conn.Write(request); err != nil {
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error of sending request to google: %v", err)})
-		return nil, fmt.Errorf("error of sending request to google: %s", err)
+	if err := rcv.parseGoogleResponse(ctx, resp); err != nil {
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error parse answer from %s: %v", rcv.upstream.Address(), err)})
+		return nil, fmt.Errorf("error reading answer from %s: %s", rcv.upstream.Address(), err)
 	}
 
-	data := make([]byte, rcv.msgSize)
-	n, err := conn.Read(data)
+	return resp, nil
+}
+
+// send forwards query with a random ID and case and returns the answer
+// restored to the client's ID and spelling. Once the upstream is known not
+// to echo the case, the names go out in lower case instead.
+func (rcv *DNSReceiver) send(ctx context.Context, query *message.Msg) (*message.Msg, error) {
+	// never reuse the client's ID and spelling, a forged answer has to guess both
+	out := query.Copy()
+	out.Header.ID = uint16(rand.Uint32())
+	randomize := !rcv.noCase.Load()
+	if randomize {
+		out.RandomizeCase()
+	} else {
+		for i := range out.Question {
+			out.Question[i].Name = strings.ToLower(out.Question[i].Name)
+		}
+	}
+	out.SetPayloadSize(uint16(rcv.msgSize))
+
+	msg, err := out.Pack()
 	if err != nil {
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error reading answer from google: %v", err)})
-		return nil, fmt.Errorf("error reading answer from google: %s", err)
+		return nil, err
 	}
 
-	if err := rcv.parseGoogleResponse(ctx, data[:n]); err != nil {
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error parse answer from google: %v", err)})
-		return nil, fmt.Errorf("error reading answer from google: %s", err)
+	data, err := rcv.upstream.Exchange(ctx, msg)
+	if err != nil {
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error exchanging with %s: %v", rcv.upstream.Address(), err)})
+		rcv.countCase(randomize, err)
+		return nil, err
+	}
+
+	var resp message.Msg
+	if err := resp.Unpack(data); err != nil {
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error parse answer from %s: %v", rcv.upstream.Address(), err)})
+		return nil, fmt.Errorf("error reading answer from %s: %s", rcv.upstream.Address(), err)
+	}
+	err = message.ValidateResponse(out, &resp)
+	rcv.countCase(randomize, err)
+	if err != nil {
+		rcv.dropped.Add(1)
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Dropped answer from %s: %v", rcv.upstream.Address(), err)})
+		return nil, err
 	}
+	resp.RestoreQuery(query)
+
+	return &resp, nil
+}
 
-	return data[:n], nil
+// countCase keeps track of exchanges with a randomized question that failed
+// only on its case. A single miss may be a forged answer, so 0x20 is turned
+// off after caseMissLimit of them in a row.
+func (rcv *DNSReceiver) countCase(randomized bool, err error) {
+	switch {
+	case !randomized:
+	case errors.Is(err, message.ErrCaseMismatch):
+		if rcv.caseMisses.Add(1) >= caseMissLimit && !rcv.noCase.Swap(true) {
+			rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("%s doesn't echo the case of the question, 0x20 is off for it", rcv.upstream.Address())})
+		}
+	case err == nil:
+		rcv.caseMisses.Store(0)
+	}
 }
 
-func (rcv *DNSReceiver) parseGoogleResponse(c context.Context, data []byte) error {
+// parseGoogleResponse caches the answers that pass message.Scrub and removes
+// the out-of-zone additional records from resp.
+func (rcv *DNSReceiver) parseGoogleResponse(c context.Context, resp *message.Msg) error {
 	_, cancel := context.WithTimeout(c, 15*time.Second)
 	defer cancel()
 
-	header, err := message.HandleHeader(data[:12])
+	answers, rejected, err := message.Scrub(resp)
 	if err != nil {
 		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error google dns: %v", err)})
 		return err
 	}
 
-	if rcv.che == nil {
-		rcv.lg.Log(logger.LogEntry{Info: "nil che"})
-		return fmt.Errorf("nil che")
+	for _, r := range rejected {
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Rejected record from %s: %s", rcv.upstream.Address(), r)})
 	}
 
-	offset := 12
-	for range header.Qdcount {
-		var err error
-		_, offset, err = readName(data, offset, data)
-		if err != nil {
-			rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error google dns: %v", err)})
-			return err
-		}
-		offset += 4 // skip QClass and QType
+	if rcv.che == nil {
+		return nil
 	}
 
-	for range header.Ancount {
-		name, newOffset, err := readName(data, offset, data)
-		if err != nil {
-			rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error google dns: %v", err)})
-			return err
+	// records sharing a name, type and class are cached together with the
+	// smallest TTL among them. RDATA is kept as it came on the wire, so types
+	// we know nothing about are cached too (RFC 3597).
+	var keys []cache.Key
+	rrsets := make(map[cache.Key]*cache.RRset)
+	ttls := make(map[cache.Key]uint32)
+
+	for _, rr := range answers {
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("name: %s", rr.Name)})
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("class: %d", rr.Class)})
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("type: %d", rr.Type)})
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("length: %d", len(rr.Data))})
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("ttl: %d", rr.TTL)})
+
+		if rr.Type == message.OPT {
+			continue
 		}
-		offset = newOffset
 
-		if offset+10 > len(data) {
-			rcv.lg.Log(logger.LogEntry{Info: "Error google dns: wrong answer's format"})
-			return fmt.Errorf("wrong answer's format")
+		key := cache.NewKey(rr.Name, uint16(rr.Type), uint16(rr.Class))
+		rrset, ok := rrsets[key]
+		if !ok {
+			rrset = &cache.RRset{Key: key}
+			rrsets[key], ttls[key] = rrset, rr.TTL
+			keys = append(keys, key)
 		}
-
-		Type := binary.BigEndian.Uint16(data[offset : offset+2])
-		Class := binary.BigEndian.Uint16(data[offset+2 : offset+4])
-		ttl := binary.BigEndian.Uint32(data[offset+4 : offset+8])
-		length := binary.BigEndian.Uint16(data[offset+8 : offset+10])
-		offset += 10
-
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("name: %s", name)})
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("class: %d", Class)})
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("type: %d", Type)})
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("length: %d", length)})
-		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("ttl: %d", ttl)})
-
-		var ip []byte
-		switch Type {
-		case uint16(message.A), uint16(message.AAAA):
-			ip = data[offset : offset+int(length)]
-		default:
-			rcv.lg.Log(logger.LogEntry{Info: "unsupported type of record"})
-			return fmt.Errorf("unsupported type of record")
-		}
-		rcv.che.Set(ip, name, Class, Type, length, ttl)
-		offset += int(length)
+		rrset.Records = append(rrset.Records, append([]byte(nil), rr.Data...))
+		ttls[key] = min(ttls[key], rr.TTL)
 	}
 
-	return nil
-}
-
-func readName(data []byte, offset int, origData []byte) (string, int, error) {
-	names := []string{}
-	visit := make(map[int]bool)
-
-	for offset < len(data) {
-		length := int(data[offset])
-		if length == 0 {
-			return strings.Join(names, "."), offset + 1, nil
-		}
+	for _, key := range keys {
+		rcv.che.Set(key, rrsets[key].Records, ttls[key])
+	}
 
-		if length&0xC0 == 0xC0 {
-			if offset+1 >= len(data) {
-				return "", offset, fmt.Errorf("invalid compression pointer")
-			}
-			ptr := int(binary.BigEndian.Uint16(data[offset:offset+2]) & 0x3FFF)
-			if visit[ptr] {
-				return "", offset, fmt.Errorf("compression is cycled")
-			}
-			visit[ptr] = true
-			name, _, err := readName(data[ptr:], 0, origData)
-			if err != nil {
-				return "", offset, err
-			}
-			names = append(names, name)
-			return strings.Join(names, "."), offset + 2, nil
-		}
-		if offset+1+length > len(data) {
-			return "", offset, fmt.Errorf("invalid label length")
+	// NXDOMAIN holds for every type of the name, NODATA only for the asked one
+	neg, err := message.ParseNegative(resp)
+	if err != nil {
+		rcv.lg.Log(logger.LogEntry{Info: fmt.Sprintf("Error reading denial from %s: %v", rcv.upstream.Address(), err)})
+		return nil
+	}
+	if neg != nil {
+		key := cache.NewKey(neg.Name, uint16(neg.Type), uint16(neg.Class))
+		if neg.Rcode == message.RcodeNameError {
+			key = cache.NXDomainKey(neg.Name, uint16(neg.Class))
 		}
-		names = append(names, string(data[offset+1:offset+1+length]))
-		offset += 1 + length
+		rcv.che.SetNegative(key, neg.Rcode, neg.SOA.Name, neg.SOA.Data, neg.TTL)
 	}
-	return "", offset, fmt.Errorf("unexpected EOF")
+
+	return nil
 }
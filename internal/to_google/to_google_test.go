@@ -1,9 +1,22 @@
 package to_google
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/cache"
+	"github.com/Vladroon22/DNS-Server/internal/config"
+	"github.com/Vladroon22/DNS-Server/internal/logger"
+	"github.com/Vladroon22/DNS-Server/internal/message"
+	"github.com/Vladroon22/DNS-Server/internal/upstream"
 )
 
 func TestRequestToGoogle(t *testing.T) {
@@ -22,26 +35,516 @@ func TestRequestToGoogle(t *testing.T) {
 		0x00, 0x01, 0x00, 0x01,
 	}
 
-	var conn net.Conn
-	for _, dns := range DNSServers {
-		var err error
-		conn, err = net.DialTimeout("udp", dns, time.Second*3)
+	upstreams, err := upstream.ParseList(config.DefaultUpstreams, 512)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	for _, up := range upstreams {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		_, err = up.Exchange(ctx, dnsQuery)
+		cancel()
 		if err == nil {
 			break
-		} else {
-			t.Logf("%v\n", err)
-			continue
 		}
+		t.Logf("%s: %v\n", up.Address(), err)
 	}
-	defer conn.Close()
 
-	if _, err := conn.Write([]byte(dnsQuery)); err != nil {
+	if err != nil {
 		t.Errorf("%v\n", err)
 	}
+}
+
+// startTruncatingUpstream serves UDP answers with TC=1 and full answers over
+// TCP on the same loopback port.
+func startTruncatingUpstream(t *testing.T) string {
+	t.Helper()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	t.Cleanup(func() { tcp.Close() })
 
-	resp := make([]byte, 512)
-	if _, err := conn.Read(resp); err != nil {
-		t.Errorf("%v\n", err)
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { udp.Close() })
+
+	answer := func(query []byte, truncated bool) []byte {
+		resp := append([]byte(nil), query...)
+		if truncated {
+			binary.BigEndian.PutUint16(resp[2:4], 0x8380) // QR, TC, RD, RA
+			return resp
+		}
+		binary.BigEndian.PutUint16(resp[2:4], 0x8180)
+		binary.BigEndian.PutUint16(resp[6:8], 1)
+		return append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 1, 0x2C, 0, 4, 10, 1, 2, 3)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(answer(buf[:n], true), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			query, err := message.ReadFramed(conn)
+			if err == nil {
+				message.WriteFramed(conn, answer(query, false))
+			}
+			conn.Close()
+		}
+	}()
+
+	return tcp.Addr().String()
+}
+
+func TestTruncatedAnswerRetriedOverTCP(t *testing.T) {
+	addr := startTruncatingUpstream(t)
+
+	lg := logger.NewLogger()
+	go lg.StartLogging()
+	t.Cleanup(lg.Stop)
+
+	che := cache.InitCache()
+	t.Cleanup(che.Close)
+
+	rcv := NewDNSReceiver(che, upstream.NewUDP(addr, 1232), 1232, lg)
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+
+	resp, err := rcv.RequestToGoogleDNS(context.Background(), query)
+	if err != nil {
+		t.Fatalf("RequestToGoogleDNS: %v", err)
+	}
+
+	var msg message.Msg
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if msg.Truncated() {
+		t.Error("truncated UDP answer was returned instead of the TCP one")
+	}
+	if len(msg.Answer) != 1 {
+		t.Errorf("expected 1 answer, got %d", len(msg.Answer))
+	}
+	if _, ok := che.Get(cache.NewKey("example.com", uint16(message.A), uint16(message.IN))); !ok {
+		t.Error("answer from TCP retry was not cached")
+	}
+}
+
+// recordingUpstream answers through answer and keeps the last query it got.
+type recordingUpstream struct {
+	last   []byte
+	answer func(query []byte) []byte
+}
+
+func (r *recordingUpstream) Address() string { return "fake" }
+
+func (r *recordingUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	r.last = append([]byte(nil), msg...)
+	return r.answer(msg), nil
+}
+
+func echoAnswer(query []byte) []byte {
+	resp := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(resp[2:4], 0x8180)
+	binary.BigEndian.PutUint16(resp[6:8], 1)
+	return append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 1, 0x2C, 0, 4, 10, 1, 2, 3)
+}
+
+func newTestReceiver(t *testing.T, up upstream.Upstream) *DNSReceiver {
+	t.Helper()
+
+	lg := logger.NewLogger()
+	go lg.StartLogging()
+	t.Cleanup(lg.Stop)
+
+	che := cache.InitCache()
+	t.Cleanup(che.Close)
+
+	return NewDNSReceiver(che, up, 1232, lg)
+}
+
+func TestQueryIDAndCaseRandomized(t *testing.T) {
+	up := &recordingUpstream{answer: echoAnswer}
+	rcv := newTestReceiver(t, up)
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
 	}
 
+	idChanged, caseChanged := false, false
+	for range 20 {
+		resp, err := rcv.RequestToGoogleDNS(context.Background(), query)
+		if err != nil {
+			t.Fatalf("RequestToGoogleDNS: %v", err)
+		}
+
+		if !bytes.Equal(up.last[0:2], query[0:2]) {
+			idChanged = true
+		}
+		if !bytes.Equal(up.last[12:25], query[12:25]) {
+			caseChanged = true
+		}
+
+		// клиент должен получить свой ID и своё написание имени
+		if !bytes.Equal(resp[:2], query[:2]) || !bytes.Equal(resp[12:29], query[12:29]) {
+			t.Fatalf("client's ID or question not restored: % x", resp[:29])
+		}
+	}
+
+	if !idChanged {
+		t.Error("upstream always saw the client's ID")
+	}
+	if !caseChanged {
+		t.Error("qname case was never randomized")
+	}
+	if rcv.Dropped() != 0 {
+		t.Errorf("valid answers were dropped: %d", rcv.Dropped())
+	}
+}
+
+func TestMismatchedAnswerDropped(t *testing.T) {
+	tests := []struct {
+		name  string
+		forge func(resp []byte)
+	}{
+		{"wrong ID", func(resp []byte) { resp[0] ^= 0xFF }},
+		{"not a response", func(resp []byte) { resp[2] &^= 0x80 }},
+		{"other name", func(resp []byte) { resp[14] = 'z' }},
+	}
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := &recordingUpstream{answer: func(q []byte) []byte {
+				resp := echoAnswer(q)
+				tt.forge(resp)
+				return resp
+			}}
+			rcv := newTestReceiver(t, up)
+
+			_, err := rcv.RequestToGoogleDNS(context.Background(), query)
+			if !errors.Is(err, message.ErrMismatchedResponse) {
+				t.Fatalf("expected ErrMismatchedResponse, got %v", err)
+			}
+			if rcv.Dropped() != 1 {
+				t.Errorf("expected 1 dropped answer, got %d", rcv.Dropped())
+			}
+			if _, ok := rcv.che.Get(cache.NewKey("example.com", uint16(message.A), uint16(message.IN))); ok {
+				t.Error("forged answer was cached")
+			}
+		})
+	}
+}
+
+func TestCaseFoldingUpstreamLosesRandomization(t *testing.T) {
+	fold := true
+	up := &recordingUpstream{answer: func(q []byte) []byte {
+		resp := echoAnswer(q)
+		if fold {
+			// апстрим не сохраняет регистр имени из вопроса
+			end := 12 + bytes.IndexByte(resp[12:], 0)
+			copy(resp[12:end], bytes.ToLower(resp[12:end]))
+		}
+		return resp
+	}}
+	rcv := newTestReceiver(t, up)
+
+	query, err := (&message.Msg{
+		Header:   message.Header{ID: 0x1234, Flags: 0x0100},
+		Question: []message.Question{{Name: "Case.Insensitive.Example.com", Type: message.A, Class: message.IN}},
+	}).Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	// отдельные промахи не отключают 0x20
+	for _, folds := range []bool{true, true, false, true, true} {
+		fold = folds
+		_, err := rcv.RequestToGoogleDNS(context.Background(), query)
+		if folds != errors.Is(err, message.ErrCaseMismatch) {
+			t.Fatalf("fold %v: unexpected error %v", folds, err)
+		}
+	}
+	if rcv.noCase.Load() {
+		t.Fatal("0x20 turned off without enough misses in a row")
+	}
+
+	fold = true
+	if _, err := rcv.RequestToGoogleDNS(context.Background(), query); !errors.Is(err, message.ErrCaseMismatch) {
+		t.Fatalf("expected ErrCaseMismatch, got %v", err)
+	}
+
+	resp, err := rcv.RequestToGoogleDNS(context.Background(), query)
+	if err != nil {
+		t.Fatalf("RequestToGoogleDNS after %d misses: %v", caseMissLimit, err)
+	}
+	if !bytes.Equal(up.last[12:42], bytes.ToLower(query[12:42])) {
+		t.Errorf("expected the name in lower case, upstream got %q", up.last[12:42])
+	}
+	if !bytes.Equal(resp[:2], query[:2]) || !bytes.Equal(resp[12:46], query[12:46]) {
+		t.Errorf("client's ID or question not restored: % x", resp[:46])
+	}
+}
+
+func TestOutOfBailiwickAnswerNotCached(t *testing.T) {
+	up := &recordingUpstream{answer: func(q []byte) []byte {
+		resp := echoAnswer(q)
+		binary.BigEndian.PutUint16(resp[6:8], 2)
+		resp = append(resp, 0x04, 'e', 'v', 'i', 'l', 0x03, 'c', 'o', 'm', 0x00)
+		return append(resp, 0, 1, 0, 1, 0, 0, 1, 0x2C, 0, 4, 6, 6, 6, 6)
+	}}
+	rcv := newTestReceiver(t, up)
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+
+	if _, err := rcv.RequestToGoogleDNS(context.Background(), query); err != nil {
+		t.Fatalf("RequestToGoogleDNS: %v", err)
+	}
+
+	if _, ok := rcv.che.Get(cache.NewKey("example.com", uint16(message.A), uint16(message.IN))); !ok {
+		t.Error("in-bailiwick answer was not cached")
+	}
+	if _, ok := rcv.che.Get(cache.NewKey("evil.com", uint16(message.A), uint16(message.IN))); ok {
+		t.Error("out-of-bailiwick answer was cached")
+	}
+}
+
+// blockingUpstream holds every exchange until release is closed.
+type blockingUpstream struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingUpstream) Address() string { return "blocking" }
+
+func (b *blockingUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	b.calls.Add(1)
+	select {
+	case <-b.release:
+		return echoAnswer(msg), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestIdenticalQueriesCoalesced(t *testing.T) {
+	up := &blockingUpstream{release: make(chan struct{})}
+	rcv := newTestReceiver(t, up)
+
+	const clients = 10
+	names := []string{"example", "EXAMPLE", "ExAmPlE"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := range clients {
+		query := []byte{
+			0x00, byte(i), 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+			0x00, 0x01, 0x00, 0x01,
+		}
+		copy(query[13:20], names[i%len(names)])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := rcv.RequestToGoogleDNS(context.Background(), query)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// каждый клиент получает свой ID и своё написание имени
+			if !bytes.Equal(resp[:2], query[:2]) || !bytes.Equal(resp[12:29], query[12:29]) {
+				errs <- fmt.Errorf("client %d got % x", query[1], resp[:29])
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for rcv.CoalesceStats().Waiting != clients-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters never gathered: %+v", rcv.CoalesceStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := rcv.CoalesceStats(); stats.InFlight != 1 {
+		t.Errorf("expected one exchange in flight, got %+v", stats)
+	}
+
+	close(up.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if calls := up.calls.Load(); calls != 1 {
+		t.Errorf("expected a single upstream exchange, got %d", calls)
+	}
+	if stats := rcv.CoalesceStats(); stats.Coalesced != clients-1 || stats.InFlight != 0 || stats.Waiting != 0 {
+		t.Errorf("unexpected stats after the answer: %+v", stats)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	plain := &message.Msg{
+		Header:   message.Header{ID: 0x1234, Flags: 0x0100},
+		Question: []message.Question{{Name: "example.com", Type: message.A, Class: message.IN}},
+	}
+	withDO := plain.Copy()
+	withDO.SetEDNS(&message.EDNS{UDPSize: 1232, DO: true})
+	aaaa := plain.Copy()
+	aaaa.Question[0].Type = message.AAAA
+
+	keyPlain, _ := coalesceKey(plain)
+	keyDO, _ := coalesceKey(withDO)
+	keyAAAA, _ := coalesceKey(aaaa)
+	if keyPlain == keyDO || keyPlain == keyAAAA {
+		t.Errorf("different queries share a key: %q %q %q", keyPlain, keyDO, keyAAAA)
+	}
+
+	upper := plain.Copy()
+	upper.Question[0].Name = "Example.com"
+	if keyUpper, _ := coalesceKey(upper); keyUpper != keyPlain {
+		t.Errorf("case changed the key: %q %q", keyUpper, keyPlain)
+	}
+
+	// второй вопрос в ключ не попадает, такие запросы не объединяются
+	two := plain.Copy()
+	two.Question = append(two.Question, message.Question{Name: "example.org", Type: message.A, Class: message.IN})
+	if key, ok := coalesceKey(two); ok {
+		t.Errorf("query with two questions got key %q", key)
+	}
+}
+
+func TestMultiAddressAnswerCachedAsRRset(t *testing.T) {
+	up := &recordingUpstream{answer: func(q []byte) []byte {
+		resp := echoAnswer(q)
+		binary.BigEndian.PutUint16(resp[6:8], 2)
+		return append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 2, 4)
+	}}
+	rcv := newTestReceiver(t, up)
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+	if _, err := rcv.RequestToGoogleDNS(context.Background(), query); err != nil {
+		t.Fatalf("RequestToGoogleDNS: %v", err)
+	}
+
+	rrset, ok := rcv.che.Get(cache.NewKey("example.com", uint16(message.A), uint16(message.IN)))
+	if !ok || len(rrset.Records) != 2 {
+		t.Fatalf("expected both addresses cached, got %+v", rrset)
+	}
+	if ttl := time.Until(rrset.Exp); ttl > 60*time.Second {
+		t.Errorf("RRset TTL must be the smallest of its records, got %v", ttl)
+	}
+}
+
+func TestAllRecordTypesCached(t *testing.T) {
+	up := &recordingUpstream{answer: func(q []byte) []byte {
+		resp := echoAnswer(q)[:len(q)] // без A-записи
+		binary.BigEndian.PutUint16(resp[6:8], 3)
+		// www.example.com CNAME cdn.example.com, имя цели сжато
+		resp = append(resp, 0xC0, 0x0C, 0, 5, 0, 1, 0, 0, 1, 0x2C, 0, 6, 3, 'c', 'd', 'n', 0xC0, 0x10)
+		cdn := len(resp) - 6
+		// cdn.example.com MX 10 mail.example.com
+		resp = append(resp, 0xC0, byte(cdn), 0, 15, 0, 1, 0, 0, 1, 0x2C, 0, 9, 0, 10, 4, 'm', 'a', 'i', 'l', 0xC0, 0x10)
+		// cdn.example.com TYPE65280, неизвестный тип хранится как есть
+		return append(resp, 0xC0, byte(cdn), 0xFF, 0x00, 0, 1, 0, 0, 1, 0x2C, 0, 3, 0xC0, 0x0C, 0x01)
+	}}
+	rcv := newTestReceiver(t, up)
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x03, 'w', 'w', 'w', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x0F, 0x00, 0x01,
+	}
+	if _, err := rcv.RequestToGoogleDNS(context.Background(), query); err != nil {
+		t.Fatalf("RequestToGoogleDNS: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []byte
+	}{
+		{"www.example.com", uint16(message.CNAME), []byte{3, 'c', 'd', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{"cdn.example.com", uint16(message.MX), []byte{0, 10, 4, 'm', 'a', 'i', 'l', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{"cdn.example.com", 0xFF00, []byte{0xC0, 0x0C, 0x01}},
+	}
+
+	for _, tt := range tests {
+		rrset, ok := rcv.che.Get(cache.NewKey(tt.name, tt.qtype, uint16(message.IN)))
+		if !ok || len(rrset.Records) != 1 {
+			t.Errorf("%s type %d not cached", tt.name, tt.qtype)
+			continue
+		}
+		if !bytes.Equal(rrset.Records[0], tt.want) {
+			t.Errorf("%s type %d: RDATA % x, expected % x", tt.name, tt.qtype, rrset.Records[0], tt.want)
+		}
+	}
+}
+
+func TestNXDomainCachedWithSOA(t *testing.T) {
+	up := &recordingUpstream{answer: func(q []byte) []byte {
+		resp := append([]byte(nil), q...)
+		binary.BigEndian.PutUint16(resp[2:4], 0x8183)
+		binary.BigEndian.PutUint16(resp[8:10], 1)
+		// MINIMUM 600 меньше TTL записи, он и задаёт срок
+		soa := []byte{3, 'n', 's', '1', 0xC0, 0x14, 5, 'a', 'd', 'm', 'i', 'n', 0xC0, 0x14}
+		soa = append(soa, make([]byte, 16)...)
+		soa = binary.BigEndian.AppendUint32(soa, 600)
+		resp = append(resp, 0xC0, 0x14, 0, 6, 0, 1, 0, 0, 0x0E, 0x10, 0, byte(len(soa)))
+		return append(resp, soa...)
+	}}
+	rcv := newTestReceiver(t, up)
+
+	query := []byte{
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'm', 'i', 's', 's', 'i', 'n', 'g', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+	if _, err := rcv.RequestToGoogleDNS(context.Background(), query); err != nil {
+		t.Fatalf("RequestToGoogleDNS: %v", err)
+	}
+
+	rrset, ok := rcv.che.Get(cache.NXDomainKey("missing.example.com", uint16(message.IN)))
+	if !ok || rrset.Rcode != message.RcodeNameError || rrset.SOAName != "example.com" {
+		t.Fatalf("NXDOMAIN not cached: %+v", rrset)
+	}
+	if ttl := time.Until(rrset.Exp); ttl > 600*time.Second || ttl < 590*time.Second {
+		t.Errorf("negative TTL must come from the SOA MINIMUM, got %v", ttl)
+	}
 }
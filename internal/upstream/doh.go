@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+const dnsMessageType = "application/dns-message"
+
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+// NewDoH returns a DNS-over-HTTPS upstream (RFC 8484) that POSTs queries to
+// url.
+func NewDoH(url string) Upstream {
+	return &dohUpstream{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				MaxIdleConns:      8,
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) Address() string {
+	return u.url
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s: %s", u.url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, fmt.Errorf("DoH upstream %s: unexpected content type %q", u.url, ct)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, message.MaxTCPMsgSize))
+}
@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ewmaWeight is the share of the newest sample in the latency average.
+const ewmaWeight = 0.3
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (c circuitState) String() string {
+	switch c {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Stats is a snapshot of the health of one upstream.
+type Stats struct {
+	Address  string
+	Requests uint64
+	Errors   uint64
+	Timeouts uint64
+	Wins     uint64        // queries answered by this upstream
+	Latency  time.Duration // exponentially weighted moving average
+	State    string
+}
+
+// health tracks results of one upstream and trips a circuit breaker after
+// threshold consecutive failures. An open circuit lets a single trial request
+// through once cooldown has passed.
+type health struct {
+	mtx        sync.Mutex
+	threshold  int
+	cooldown   time.Duration
+	state      circuitState
+	failures   int
+	openedAt   time.Time
+	requests   uint64
+	errors     uint64
+	timeouts   uint64
+	wins       uint64
+	latency    time.Duration
+	hasSamples bool
+}
+
+func newHealth(threshold int, cooldown time.Duration) *health {
+	return &health{
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+	}
+}
+
+// allow reports whether a request may be sent now. Moving an open circuit to
+// half-open hands out the single trial request.
+func (h *health) allow() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	switch h.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Since(h.openedAt) >= h.cooldown {
+			h.state = circuitHalfOpen
+			return true
+		}
+	}
+	return false
+}
+
+func (h *health) success(latency time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.requests++
+	h.failures = 0
+	h.state = circuitClosed
+
+	if !h.hasSamples {
+		h.latency, h.hasSamples = latency, true
+		return
+	}
+	h.latency = time.Duration(ewmaWeight*float64(latency) + (1-ewmaWeight)*float64(h.latency))
+}
+
+func (h *health) failure(err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.requests++
+	h.errors++
+	if isTimeout(err) {
+		h.timeouts++
+	}
+
+	h.failures++
+	if h.state == circuitHalfOpen || h.failures >= h.threshold {
+		h.state = circuitOpen
+		h.openedAt = time.Now()
+	}
+}
+
+// win records that the answer of this upstream was the one sent to the client.
+func (h *health) win() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.wins++
+}
+
+// release gives back a half-open trial that ended without a verdict.
+func (h *health) release() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.state == circuitHalfOpen {
+		h.state = circuitOpen
+	}
+}
+
+func (h *health) isOpen() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return h.state != circuitClosed
+}
+
+func (h *health) ewma() (time.Duration, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return h.latency, h.hasSamples
+}
+
+func (h *health) stats(addr string) Stats {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return Stats{
+		Address:  addr,
+		Requests: h.requests,
+		Errors:   h.errors,
+		Timeouts: h.timeouts,
+		Wins:     h.wins,
+		Latency:  h.latency,
+		State:    h.state.String(),
+	}
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,319 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// ErrNoUpstreams is returned by a pool without members.
+var ErrNoUpstreams = errors.New("no upstreams configured")
+
+// probeTimeout bounds a probe when the pool has no Timeout of its own.
+const probeTimeout = 5 * time.Second
+
+type PoolConfig struct {
+	Strategy      Strategy
+	Timeout       time.Duration // per upstream attempt
+	FailThreshold int           // consecutive failures that open the circuit
+	Cooldown      time.Duration // time an open circuit rejects requests
+	ProbeInterval time.Duration // how often open circuits are probed, 0 disables
+	Parallel      int           // upstreams queried at once, first answer wins
+	HedgeDelay    time.Duration // start the next upstream if no answer came in time, 0 disables
+}
+
+type member struct {
+	up     Upstream
+	health *health
+}
+
+// Pool spreads queries over several upstreams. It fails over to the next
+// upstream on errors, SERVFAIL and REFUSED, and skips upstreams whose circuit
+// breaker is open. With Parallel or HedgeDelay set it races upstreams against
+// each other and cancels the losers. Pool is itself an Upstream.
+type Pool struct {
+	members    []*member
+	strategy   Strategy
+	timeout    time.Duration
+	parallel   int
+	hedgeDelay time.Duration
+	next       uint64
+	exitCh     chan struct{}
+	once       sync.Once
+}
+
+func NewPool(upstreams []Upstream, cfg PoolConfig) *Pool {
+	p := &Pool{
+		strategy:   cfg.Strategy,
+		timeout:    cfg.Timeout,
+		parallel:   max(cfg.Parallel, 1),
+		hedgeDelay: cfg.HedgeDelay,
+		exitCh:     make(chan struct{}),
+	}
+	if p.strategy == "" {
+		p.strategy = Sequential
+	}
+
+	for _, up := range upstreams {
+		p.members = append(p.members, &member{
+			up:     up,
+			health: newHealth(cfg.FailThreshold, cfg.Cooldown),
+		})
+	}
+
+	if cfg.ProbeInterval > 0 {
+		go p.probe(cfg.ProbeInterval)
+	}
+
+	return p
+}
+
+func (p *Pool) Address() string {
+	return fmt.Sprintf("pool(%s, %d upstreams)", p.strategy, len(p.members))
+}
+
+// result is the outcome of one upstream attempt.
+type result struct {
+	m     *member
+	resp  []byte
+	rcode uint8
+	err   error
+}
+
+// failures keeps the most useful outcome of the failed attempts: a SERVFAIL
+// answer is still better for the client than a transport error.
+type failures struct {
+	resp []byte
+	err  error
+}
+
+func (f *failures) add(r result) {
+	if r.err != nil {
+		f.err = fmt.Errorf("%s: %w", r.m.up.Address(), r.err)
+		return
+	}
+	f.resp = r.resp
+}
+
+func (f *failures) final() ([]byte, error) {
+	if f.resp != nil {
+		return f.resp, nil
+	}
+	return nil, fmt.Errorf("all upstreams failed: %w", f.err)
+}
+
+func (p *Pool) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	if len(p.members) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	next := p.candidates()
+	if p.parallel > 1 || p.hedgeDelay > 0 {
+		return p.race(ctx, msg, next)
+	}
+
+	var failed failures
+	for m := next(); m != nil; m = next() {
+		r := p.exchange(ctx, m, msg)
+		if r.ok() {
+			m.health.win()
+			return r.resp, nil
+		}
+		failed.add(r)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return failed.final()
+}
+
+// race queries p.parallel upstreams at once and adds another one whenever an
+// attempt fails or HedgeDelay passes without an answer. The first good answer
+// wins and cancels the rest.
+func (p *Pool) race(ctx context.Context, msg []byte, next func() *member) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(p.members))
+	pending := 0
+	launch := func() bool {
+		m := next()
+		if m == nil {
+			return false
+		}
+		pending++
+		go func() { results <- p.exchange(ctx, m, msg) }()
+		return true
+	}
+
+	for range p.parallel {
+		if !launch() {
+			break
+		}
+	}
+
+	var hedge <-chan time.Time
+	resetHedge := func() {
+		if p.hedgeDelay > 0 {
+			hedge = time.After(p.hedgeDelay)
+		}
+	}
+	resetHedge()
+
+	var failed failures
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.ok() {
+				r.m.health.win()
+				return r.resp, nil
+			}
+			failed.add(r)
+			if launch() {
+				resetHedge()
+			}
+		case <-hedge:
+			hedge = nil
+			if launch() {
+				resetHedge()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return failed.final()
+}
+
+// candidates returns an iterator over the members in strategy order, skipping
+// those with an open circuit. If every circuit is open it goes over all of
+// them anyway, since trying beats failing outright. Circuits are checked
+// lazily so a half-open trial is only handed out to a member really queried.
+func (p *Pool) candidates() func() *member {
+	order := p.order()
+	pos, yielded, fallback := 0, 0, false
+
+	return func() *member {
+		for {
+			for pos < len(order) {
+				m := p.members[order[pos]]
+				pos++
+				if fallback || m.health.allow() {
+					yielded++
+					return m
+				}
+			}
+
+			if fallback || yielded > 0 {
+				return nil
+			}
+			fallback, pos = true, 0
+		}
+	}
+}
+
+func (r result) ok() bool {
+	return r.err == nil && !isServerFailure(r.rcode)
+}
+
+func (p *Pool) exchange(ctx context.Context, m *member, msg []byte) result {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	resp, err := m.up.Exchange(ctx, msg)
+
+	var reply message.Msg
+	if err == nil {
+		err = reply.Unpack(resp)
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// lost a race or the client went away, not the upstream's fault
+		m.health.release()
+		return result{m: m, err: err}
+	case err != nil:
+		m.health.failure(err)
+		return result{m: m, err: err}
+	case isServerFailure(reply.Rcode()):
+		m.health.failure(fmt.Errorf("answered with RCODE %d", reply.Rcode()))
+	default:
+		m.health.success(time.Since(start))
+	}
+
+	return result{m: m, resp: resp, rcode: reply.Rcode()}
+}
+
+// Stats returns the health of every member in configured order.
+func (p *Pool) Stats() []Stats {
+	stats := make([]Stats, 0, len(p.members))
+	for _, m := range p.members {
+		stats = append(stats, m.health.stats(m.up.Address()))
+	}
+	return stats
+}
+
+// probe periodically sends a root NS query to upstreams with an open circuit
+// so that they come back as soon as they recover, not on a client's query.
+func (p *Pool) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Close cuts a running probe short
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.exitCh
+		cancel()
+	}()
+
+	timeout := probeTimeout
+	if p.timeout > 0 {
+		timeout = p.timeout
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, m := range p.members {
+				if m.health.isOpen() && m.health.allow() {
+					pctx, pcancel := context.WithTimeout(ctx, timeout)
+					p.exchange(pctx, m, probeQuery())
+					pcancel()
+				}
+			}
+		case <-p.exitCh:
+			return
+		}
+	}
+}
+
+func (p *Pool) Close() {
+	p.once.Do(func() { close(p.exitCh) })
+}
+
+// probeQuery asks for the NS records of the root zone.
+func probeQuery() []byte {
+	query := &message.Msg{
+		Header:   message.Header{ID: uint16(rand.Uint32())},
+		Question: []message.Question{{Name: "", Type: message.NS, Class: message.IN}},
+	}
+	data, _ := query.Pack() // the root name always packs
+	return data
+}
+
+func isServerFailure(rcode uint8) bool {
+	return rcode == message.RcodeServerFailure || rcode == message.RcodeRefused
+}
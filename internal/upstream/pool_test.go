@@ -0,0 +1,423 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeUpstream struct {
+	addr  string
+	delay time.Duration
+	rcode byte
+	calls atomic.Int32
+
+	mtx sync.Mutex
+	err error
+}
+
+func (f *fakeUpstream) Address() string { return f.addr }
+
+func (f *fakeUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	f.calls.Add(1)
+
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	f.mtx.Lock()
+	err := f.err
+	f.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := answerFor(msg)
+	resp[3] |= f.rcode
+	return resp, nil
+}
+
+func (f *fakeUpstream) setErr(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.err = err
+}
+
+func TestPoolFailover(t *testing.T) {
+	servfail := &fakeUpstream{addr: "servfail", rcode: 2}
+	broken := &fakeUpstream{addr: "broken", err: errors.New("connection refused")}
+	good := &fakeUpstream{addr: "good"}
+
+	pool := NewPool([]Upstream{servfail, broken, good}, PoolConfig{FailThreshold: 3, Cooldown: time.Minute})
+	defer pool.Close()
+
+	resp, err := pool.Exchange(context.Background(), testQuery)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if rcode := resp[3] & 0xF; rcode != 0 {
+		t.Errorf("expected answer from the healthy upstream, got RCODE %d", rcode)
+	}
+
+	stats := pool.Stats()
+	if stats[0].Errors != 1 || stats[1].Errors != 1 || stats[2].Errors != 0 {
+		t.Errorf("unexpected error counters: %+v", stats)
+	}
+}
+
+func TestPoolTimeoutCounted(t *testing.T) {
+	slow := &fakeUpstream{addr: "slow", delay: time.Second}
+	good := &fakeUpstream{addr: "good"}
+
+	pool := NewPool([]Upstream{slow, good}, PoolConfig{Timeout: 50 * time.Millisecond, FailThreshold: 3})
+	defer pool.Close()
+
+	if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if stats := pool.Stats(); stats[0].Timeouts != 1 {
+		t.Errorf("timeout was not recorded: %+v", stats[0])
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	flaky := &fakeUpstream{addr: "flaky", err: errors.New("unreachable")}
+	good := &fakeUpstream{addr: "good"}
+
+	pool := NewPool([]Upstream{flaky, good}, PoolConfig{FailThreshold: 2, Cooldown: 100 * time.Millisecond})
+	defer pool.Close()
+
+	for range 5 {
+		if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+	}
+
+	if calls := flaky.calls.Load(); calls != 2 {
+		t.Errorf("open circuit must stop requests after 2 failures, got %d calls", calls)
+	}
+	if state := pool.Stats()[0].State; state != "open" {
+		t.Errorf("expected open circuit, got %s", state)
+	}
+
+	// После cooldown пропускается один пробный запрос
+	flaky.setErr(nil)
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if state := pool.Stats()[0].State; state != "closed" {
+		t.Errorf("successful trial must close the circuit, got %s", state)
+	}
+}
+
+func TestPoolProbesOpenCircuits(t *testing.T) {
+	flaky := &fakeUpstream{addr: "flaky", err: errors.New("unreachable")}
+
+	pool := NewPool([]Upstream{flaky}, PoolConfig{
+		FailThreshold: 1,
+		Cooldown:      20 * time.Millisecond,
+		ProbeInterval: 20 * time.Millisecond,
+	})
+	defer pool.Close()
+
+	if _, err := pool.Exchange(context.Background(), testQuery); err == nil {
+		t.Fatal("expected an error from the only upstream")
+	}
+
+	flaky.setErr(nil)
+
+	deadline := time.Now().Add(time.Second)
+	for pool.Stats()[0].State != "closed" {
+		if time.Now().After(deadline) {
+			t.Fatal("background probe did not close the circuit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stuckUpstream never answers and hands out the context of every exchange.
+type stuckUpstream struct {
+	ctxs chan context.Context
+}
+
+func (s *stuckUpstream) Address() string { return "stuck" }
+
+func (s *stuckUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	select {
+	case s.ctxs <- ctx:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestProbeHasDeadlineAndStopsOnClose(t *testing.T) {
+	stuck := &stuckUpstream{ctxs: make(chan context.Context, 2)}
+
+	pool := NewPool([]Upstream{stuck}, PoolConfig{
+		FailThreshold: 1,
+		Cooldown:      20 * time.Millisecond,
+		ProbeInterval: 20 * time.Millisecond,
+	})
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Exchange(ctx, testQuery); err == nil {
+		t.Fatal("expected an error from the stuck upstream")
+	}
+	<-stuck.ctxs
+
+	var probe context.Context
+	select {
+	case probe = <-stuck.ctxs:
+	case <-time.After(time.Second):
+		t.Fatal("open circuit was never probed")
+	}
+	if _, ok := probe.Deadline(); !ok {
+		t.Error("probe runs without a deadline")
+	}
+
+	// закрытие пула не ждёт таймаута пробы
+	pool.Close()
+	select {
+	case <-probe.Done():
+	case <-time.After(time.Second):
+		t.Error("Close didn't cancel the running probe")
+	}
+}
+
+func TestAllCircuitsOpenStillTried(t *testing.T) {
+	broken := &fakeUpstream{addr: "broken", err: errors.New("unreachable")}
+
+	pool := NewPool([]Upstream{broken}, PoolConfig{FailThreshold: 1, Cooldown: time.Minute})
+	defer pool.Close()
+
+	pool.Exchange(context.Background(), testQuery)
+	broken.setErr(nil)
+
+	if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+		t.Errorf("upstream with an open circuit must be tried as a last resort: %v", err)
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	newUpstreams := func() []*fakeUpstream {
+		return []*fakeUpstream{
+			{addr: "a", delay: 30 * time.Millisecond},
+			{addr: "b", delay: time.Millisecond},
+			{addr: "c", delay: 10 * time.Millisecond},
+		}
+	}
+	asUpstreams := func(fakes []*fakeUpstream) []Upstream {
+		ups := make([]Upstream, len(fakes))
+		for i, f := range fakes {
+			ups[i] = f
+		}
+		return ups
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		fakes := newUpstreams()
+		pool := NewPool(asUpstreams(fakes), PoolConfig{Strategy: Sequential})
+		defer pool.Close()
+
+		for range 3 {
+			pool.Exchange(context.Background(), testQuery)
+		}
+		if fakes[0].calls.Load() != 3 {
+			t.Errorf("sequential must always use the first upstream")
+		}
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		fakes := newUpstreams()
+		pool := NewPool(asUpstreams(fakes), PoolConfig{Strategy: RoundRobin})
+		defer pool.Close()
+
+		for range 6 {
+			pool.Exchange(context.Background(), testQuery)
+		}
+		for _, f := range fakes {
+			if f.calls.Load() != 2 {
+				t.Errorf("%s: expected 2 calls, got %d", f.addr, f.calls.Load())
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		fakes := newUpstreams()
+		pool := NewPool(asUpstreams(fakes), PoolConfig{Strategy: Random})
+		defer pool.Close()
+
+		for range 30 {
+			pool.Exchange(context.Background(), testQuery)
+		}
+		if total := fakes[0].calls.Load() + fakes[1].calls.Load() + fakes[2].calls.Load(); total != 30 {
+			t.Errorf("expected one call per query, got %d", total)
+		}
+	})
+
+	t.Run("lowest latency", func(t *testing.T) {
+		fakes := newUpstreams()
+		pool := NewPool(asUpstreams(fakes), PoolConfig{Strategy: LowestLatency})
+		defer pool.Close()
+
+		// первые три запроса измеряют каждый upstream
+		for range 3 {
+			pool.Exchange(context.Background(), testQuery)
+		}
+		before := fakes[1].calls.Load()
+		for range 5 {
+			pool.Exchange(context.Background(), testQuery)
+		}
+		if fakes[1].calls.Load()-before != 5 {
+			t.Errorf("fastest upstream was not preferred: %+v", pool.Stats())
+		}
+	})
+
+	if _, err := ParseStrategy("fastest"); err == nil {
+		t.Error("unknown strategy was accepted")
+	}
+}
+
+func TestParallelFirstAnswerWins(t *testing.T) {
+	slow := &fakeUpstream{addr: "slow", delay: time.Second}
+	fast := &fakeUpstream{addr: "fast", delay: 5 * time.Millisecond}
+
+	pool := NewPool([]Upstream{slow, fast}, PoolConfig{Parallel: 2, FailThreshold: 1, Cooldown: time.Minute})
+	defer pool.Close()
+
+	start := time.Now()
+	if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("answer took %v, the slow upstream was awaited", elapsed)
+	}
+
+	stats := pool.Stats()
+	if stats[0].Wins != 0 || stats[1].Wins != 1 {
+		t.Errorf("unexpected win counters: %+v", stats)
+	}
+	// проигравший запрос отменен, но это не ошибка upstream
+	time.Sleep(20 * time.Millisecond)
+	if stats := pool.Stats(); stats[0].Errors != 0 || stats[0].State != "closed" {
+		t.Errorf("cancelled loser was penalised: %+v", stats[0])
+	}
+}
+
+func TestHedgedRequest(t *testing.T) {
+	t.Run("hedge fires", func(t *testing.T) {
+		slow := &fakeUpstream{addr: "slow", delay: time.Second}
+		fast := &fakeUpstream{addr: "fast"}
+
+		pool := NewPool([]Upstream{slow, fast}, PoolConfig{HedgeDelay: 20 * time.Millisecond})
+		defer pool.Close()
+
+		start := time.Now()
+		if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("hedged request took %v", elapsed)
+		}
+		if pool.Stats()[1].Wins != 1 {
+			t.Errorf("hedged upstream should have won: %+v", pool.Stats())
+		}
+	})
+
+	t.Run("no hedge for fast answers", func(t *testing.T) {
+		first := &fakeUpstream{addr: "first"}
+		second := &fakeUpstream{addr: "second"}
+
+		pool := NewPool([]Upstream{first, second}, PoolConfig{HedgeDelay: 100 * time.Millisecond})
+		defer pool.Close()
+
+		if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		if second.calls.Load() != 0 {
+			t.Error("second upstream was queried although the first answered in time")
+		}
+	})
+
+	t.Run("failure starts next at once", func(t *testing.T) {
+		broken := &fakeUpstream{addr: "broken", err: errors.New("unreachable")}
+		good := &fakeUpstream{addr: "good"}
+
+		pool := NewPool([]Upstream{broken, good}, PoolConfig{HedgeDelay: time.Second})
+		defer pool.Close()
+
+		start := time.Now()
+		if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("failover waited for the hedge delay: %v", elapsed)
+		}
+	})
+}
+
+// exchangeRecorder reports when the wrapped upstream gives up.
+type exchangeRecorder struct {
+	Upstream
+	done chan error
+}
+
+func (r *exchangeRecorder) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	resp, err := r.Upstream.Exchange(ctx, msg)
+	r.done <- err
+	return resp, err
+}
+
+func TestCancelledLoserReturnsPromptly(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		dial func(addr string) Upstream
+	}{
+		{"udp", func(addr string) Upstream { return NewUDP(addr, 1232) }},
+		{"tcp", NewTCP},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// медленный сервер молчит, пока тест не закончится
+			release := make(chan struct{})
+			addr := startFakeDNS(t, func([]byte, bool) []byte {
+				<-release
+				return nil
+			})
+			t.Cleanup(func() { close(release) })
+
+			slow := &exchangeRecorder{Upstream: tt.dial(addr), done: make(chan error, 1)}
+			fast := &fakeUpstream{addr: "fast", delay: 20 * time.Millisecond}
+
+			pool := NewPool([]Upstream{slow, fast}, PoolConfig{Parallel: 2, Timeout: 5 * time.Second, FailThreshold: 1, Cooldown: time.Minute})
+			defer pool.Close()
+
+			if _, err := pool.Exchange(context.Background(), testQuery); err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+
+			select {
+			case err := <-slow.done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("expected the loser to be cancelled, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("cancelled loser is still waiting for its answer")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			if stats := pool.Stats(); stats[0].Errors != 0 || stats[0].State != "closed" {
+				t.Errorf("cancelled loser was counted as a failure: %+v", stats[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync/atomic"
+)
+
+// Strategy decides in which order the upstreams of a pool are tried.
+type Strategy string
+
+const (
+	Sequential    Strategy = "sequential"     // always in configured order
+	RoundRobin    Strategy = "round_robin"    // rotate the first upstream
+	Random        Strategy = "random"         // shuffle on every query
+	LowestLatency Strategy = "lowest_latency" // fastest by EWMA latency first
+)
+
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case Sequential, RoundRobin, Random, LowestLatency:
+		return s, nil
+	case "":
+		return Sequential, nil
+	default:
+		return "", fmt.Errorf("unknown upstream strategy %q", name)
+	}
+}
+
+// order returns the indexes of the pool members in the order they should be
+// tried for the next query.
+func (p *Pool) order() []int {
+	n := len(p.members)
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+
+	switch p.strategy {
+	case RoundRobin:
+		start := int(atomic.AddUint64(&p.next, 1)-1) % n
+		for i := range idx {
+			idx[i] = (start + i) % n
+		}
+	case Random:
+		rand.Shuffle(n, func(i, j int) { idx[i], idx[j] = idx[j], idx[i] })
+	case LowestLatency:
+		// upstreams without samples go first so every one gets measured
+		sort.SliceStable(idx, func(i, j int) bool {
+			li, oki := p.members[idx[i]].health.ewma()
+			lj, okj := p.members[idx[j]].health.ewma()
+			if oki != okj {
+				return !oki
+			}
+			return li < lj
+		})
+	}
+
+	return idx
+}
@@ -0,0 +1,81 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+type tcpUpstream struct {
+	addr string
+}
+
+// NewTCP returns a plain DNS upstream reached over TCP.
+func NewTCP(addr string) Upstream {
+	return &tcpUpstream{addr: addr}
+}
+
+func (u *tcpUpstream) Address() string {
+	return "tcp://" + u.addr
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return exchangeFramed(ctx, conn, msg)
+}
+
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+}
+
+// NewTLS returns a DNS-over-TLS upstream (RFC 7858). serverName is checked
+// against the upstream certificate.
+func NewTLS(addr, serverName string) Upstream {
+	return &tlsUpstream{
+		addr: addr,
+		config: &tls.Config{
+			ServerName:         serverName,
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(8),
+		},
+	}
+}
+
+func (u *tlsUpstream) Address() string {
+	return "tls://" + u.addr
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	dialer := tls.Dialer{Config: u.config}
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return exchangeFramed(ctx, conn, msg)
+}
+
+func exchangeFramed(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	stop := bindContext(ctx, conn)
+	defer stop()
+
+	if err := message.WriteFramed(conn, msg); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+
+	resp, err := message.ReadFramed(conn)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+// bindAttempts is how many random source ports are tried before leaving the
+// choice to the kernel.
+const bindAttempts = 5
+
+var droppedResponses atomic.Uint64
+
+// DroppedResponses returns how many UDP datagrams were discarded because they
+// didn't match the query they arrived for.
+func DroppedResponses() uint64 {
+	return droppedResponses.Load()
+}
+
+type udpUpstream struct {
+	addr    string
+	msgSize int
+	tcp     *tcpUpstream
+}
+
+// NewUDP returns a plain DNS upstream. Answers that come back truncated are
+// repeated over TCP to the same address.
+func NewUDP(addr string, msgSize int) Upstream {
+	return &udpUpstream{
+		addr:    addr,
+		msgSize: max(msgSize, message.MinUDPSize),
+		tcp:     &tcpUpstream{addr: addr},
+	}
+}
+
+func (u *udpUpstream) Address() string {
+	return "udp://" + u.addr
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var query message.Msg
+	if err := query.Unpack(msg); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialRandomPort(ctx, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := bindContext(ctx, conn)
+	defer stop()
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+
+	data := make([]byte, u.msgSize)
+	var (
+		n       int
+		resp    message.Msg
+		caseErr error
+	)
+	for {
+		if n, err = conn.Read(data); err != nil {
+			if caseErr != nil {
+				// only answers in the wrong case came, the caller decides
+				// whether the upstream just doesn't echo it
+				return nil, fmt.Errorf("%w: %w", contextErr(ctx, err), caseErr)
+			}
+			return nil, contextErr(ctx, err)
+		}
+		// a forged datagram must not end the wait for the real answer, not
+		// even one that only gets the case of the question wrong
+		if resp.Unpack(data[:n]) == nil {
+			err := message.ValidateResponse(&query, &resp)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, message.ErrCaseMismatch) {
+				caseErr = err
+			}
+		}
+		droppedResponses.Add(1)
+	}
+
+	if resp.Truncated() {
+		if full, err := u.tcp.Exchange(ctx, msg); err == nil {
+			return full, nil
+		}
+		// the client can still retry over TCP itself
+	}
+
+	return data[:n], nil
+}
+
+// dialRandomPort binds the socket to a random unprivileged source port, so
+// an attacker has to guess it along with the query ID.
+func dialRandomPort(ctx context.Context, addr string) (net.Conn, error) {
+	for range bindAttempts {
+		dialer := net.Dialer{LocalAddr: &net.UDPAddr{Port: 1024 + rand.IntN(65536-1024)}}
+		conn, err := dialer.DialContext(ctx, "udp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("dial %s: %w", addr, err)
+		}
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "udp", addr)
+}
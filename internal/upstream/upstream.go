@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream is a resolver the proxy forwards queries to. Exchange sends a
+// wire-format query and returns the wire-format answer.
+type Upstream interface {
+	Exchange(ctx context.Context, msg []byte) ([]byte, error)
+	Address() string
+}
+
+// Parse builds an upstream from a URL such as udp://1.1.1.1:53,
+// tcp://10.0.0.1, tls://dns.google:853 or https://dns.google/dns-query.
+// udpSize is the largest UDP answer accepted from plain DNS upstreams.
+func Parse(raw string, udpSize int) (Upstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", raw, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream %q: missing host", raw)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return NewUDP(withPort(u, "53"), udpSize), nil
+	case "tcp":
+		return NewTCP(withPort(u, "53")), nil
+	case "tls":
+		return NewTLS(withPort(u, "853"), u.Hostname()), nil
+	case "https":
+		return NewDoH(u.String()), nil
+	default:
+		return nil, fmt.Errorf("upstream %q: unsupported scheme %q", raw, u.Scheme)
+	}
+}
+
+// ParseList parses a comma separated list of upstream URLs.
+func ParseList(list string, udpSize int) ([]Upstream, error) {
+	var upstreams []Upstream
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		up, err := Parse(raw, udpSize)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, up)
+	}
+
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+	return upstreams, nil
+}
+
+func withPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bindContext applies the deadline of ctx to conn and cuts any blocked read
+// or write short once ctx is cancelled, so the losers of a race give up their
+// sockets at once. The returned function stops watching ctx.
+func bindContext(ctx context.Context, conn net.Conn) func() bool {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+}
+
+// contextErr reports the end of ctx rather than the I/O error it caused.
+func contextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
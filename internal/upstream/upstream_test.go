@@ -0,0 +1,282 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vladroon22/DNS-Server/internal/message"
+)
+
+var testQuery = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+}
+
+// answerFor echoes query back as a response with a single A record.
+func answerFor(query []byte) []byte {
+	resp := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(resp[2:4], 0x8180)
+	binary.BigEndian.PutUint16(resp[6:8], 1)
+	return append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 1, 0x2C, 0, 4, 10, 1, 2, 3)
+}
+
+// startFakeDNS serves handler over UDP and TCP on the same loopback port.
+func startFakeDNS(t *testing.T, handler func(query []byte, tcp bool) []byte) string {
+	t.Helper()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { udp.Close() })
+
+	go func() {
+		buf := make([]byte, message.MaxTCPMsgSize)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := handler(buf[:n], false); resp != nil {
+				udp.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := message.ReadFramed(conn)
+				if err != nil {
+					return
+				}
+				if resp := handler(query, true); resp != nil {
+					message.WriteFramed(conn, resp)
+				}
+			}()
+		}
+	}()
+
+	return tcp.Addr().String()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw     string
+		address string
+		wantErr bool
+	}{
+		{"udp://1.1.1.1", "udp://1.1.1.1:53", false},
+		{"udp://10.0.0.1:5353", "udp://10.0.0.1:5353", false},
+		{"tcp://[2606:4700::1111]", "tcp://[2606:4700::1111]:53", false},
+		{"tls://dns.google", "tls://dns.google:853", false},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query", false},
+		{"quic://dns.adguard.com", "", true},
+		{"1.1.1.1:53", "", true},
+	}
+
+	for _, tt := range tests {
+		up, err := Parse(tt.raw, 1232)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q): expected an error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.raw, err)
+			continue
+		}
+		if up.Address() != tt.address {
+			t.Errorf("Parse(%q): expected address %s, got %s", tt.raw, tt.address, up.Address())
+		}
+	}
+
+	if _, err := ParseList(" , ", 1232); err == nil {
+		t.Error("empty upstream list was accepted")
+	}
+}
+
+func TestPlainExchange(t *testing.T) {
+	addr := startFakeDNS(t, func(query []byte, _ bool) []byte { return answerFor(query) })
+
+	for _, up := range []Upstream{NewUDP(addr, 1232), NewTCP(addr)} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := up.Exchange(ctx, testQuery)
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %v", up.Address(), err)
+			continue
+		}
+		if !bytes.Equal(resp, answerFor(testQuery)) {
+			t.Errorf("%s: unexpected answer %v", up.Address(), resp)
+		}
+	}
+}
+
+func TestUDPRetriesTruncatedOverTCP(t *testing.T) {
+	addr := startFakeDNS(t, func(query []byte, tcp bool) []byte {
+		if tcp {
+			return answerFor(query)
+		}
+		resp := append([]byte(nil), query...)
+		binary.BigEndian.PutUint16(resp[2:4], 0x8380) // QR, TC, RD, RA
+		return resp
+	})
+
+	resp, err := NewUDP(addr, 1232).Exchange(context.Background(), testQuery)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if !bytes.Equal(resp, answerFor(testQuery)) {
+		t.Errorf("expected the full TCP answer, got %v", resp)
+	}
+}
+
+func TestUDPDropsForgedResponses(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, message.MinUDPSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// подделка с чужим ID приходит раньше настоящего ответа
+		forged := answerFor(buf[:n])
+		forged[0] ^= 0xFF
+		pc.WriteTo(forged, addr)
+		pc.WriteTo(answerFor(buf[:n]), addr)
+	}()
+
+	before := DroppedResponses()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := NewUDP(pc.LocalAddr().String(), 512).Exchange(ctx, testQuery)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if !bytes.Equal(resp, answerFor(testQuery)) {
+		t.Error("forged response was accepted")
+	}
+	if got := DroppedResponses() - before; got != 1 {
+		t.Errorf("expected 1 dropped response, got %d", got)
+	}
+}
+
+func TestUDPWaitsForExactCase(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, message.MinUDPSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			// подделка в другом регистре не должна прервать ожидание
+			forged := answerFor(buf[:n])
+			forged[13] ^= 0x20
+			pc.WriteTo(forged, addr)
+			if buf[14] == 'x' {
+				pc.WriteTo(answerFor(buf[:n]), addr)
+			}
+		}
+	}()
+
+	before := DroppedResponses()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := NewUDP(pc.LocalAddr().String(), 512).Exchange(ctx, testQuery)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if !bytes.Equal(resp, answerFor(testQuery)) {
+		t.Error("answer in the wrong case was accepted")
+	}
+	if got := DroppedResponses() - before; got != 1 {
+		t.Errorf("expected 1 dropped response, got %d", got)
+	}
+
+	// без настоящего ответа вызывающий узнаёт, что регистр не совпал
+	other := append([]byte(nil), testQuery...)
+	other[14] = 'X'
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := NewUDP(pc.LocalAddr().String(), 512).Exchange(ctx, other); !errors.Is(err, message.ErrCaseMismatch) {
+		t.Errorf("expected a timeout with ErrCaseMismatch, got %v", err)
+	}
+}
+
+func TestUDPHonoursContext(t *testing.T) {
+	addr := startFakeDNS(t, func([]byte, bool) []byte { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := NewUDP(addr, 1232).Exchange(ctx, testQuery); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Exchange ignored the context deadline")
+	}
+}
+
+func TestDoHExchange(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(answerFor(query))
+	}))
+	defer srv.Close()
+
+	up := NewDoH(srv.URL + "/dns-query").(*dohUpstream)
+	up.client = srv.Client()
+
+	resp, err := up.Exchange(context.Background(), testQuery)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if !bytes.Equal(resp, answerFor(testQuery)) {
+		t.Errorf("unexpected answer %v", resp)
+	}
+}